@@ -2,35 +2,120 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 )
 
 // TARGET - A valid block hash has its first TARGET bits be zero.
+// Each bit doubles the work of mining a block, and so the time between blocks.
 const TARGET = 20
 
+// Version - Version of the blockchain system, reported by miners and trackers on /status.
+const Version = "1.1.0"
+
+// MaxContentSize - A valid post's content is at most MaxContentSize bytes long.
+const MaxContentSize = 4 * 1024
+
+// MaxBlockSize - The posts of a valid block take at most MaxBlockSize bytes, as measured by Post.Size.
+const MaxBlockSize = 256 * 1024
+
+// MaxBlockPosts - A valid block holds at most MaxBlockPosts posts.
+const MaxBlockPosts = 256
+
+// PostKind - What a post does. Most posts carry messages, and the others manage their users' keys.
+type PostKind byte
+
+const (
+	// PostMessage - A post that carries a message in its content. It is the zero PostKind.
+	PostMessage PostKind = iota
+	// PostRotate - A post that links its user's key to the new key in its body, which takes over the user's identity.
+	// It is signed by both keys, and its content may explain the rotation.
+	PostRotate
+	// PostRevoke - A post that revokes its user's key, so that the key's later posts are not to be trusted. It is signed
+	// by the revoked key, and its content may explain the revocation.
+	PostRevoke
+)
+
 // PostBody - Part of Post used to generate a signature.
 type PostBody struct {
 	Content   string
 	Timestamp int64
+	Kind      PostKind
+	NewKey    []byte // for PostRotate, the new key in PKIX form, as PublicKeyToBytes encodes it
 }
 
 // Post - A user's message to be sent to the blockchain.
 type Post struct {
-	User      *rsa.PublicKey // user's public key
-	Signature []byte         // generated by signing Body with User
-	Body      PostBody       // the content of the post
+	User         *PublicKey // user's public key
+	Signature    []byte     // generated by signing Body with User
+	Body         PostBody   // the content of the post
+	KeySignature []byte     // for PostRotate, generated by signing Body with the new key
 }
 
-// Verify - verifies the Post's signature matches its public key and body.
+// Verify - verifies the Post's content is within MaxContentSize, and its signature matches its public key and body.
+// A PostRotate must also be signed by a new key that differs from the user's key.
 func (p *Post) Verify() bool {
+	if len(p.Body.Content) > MaxContentSize {
+		return false
+	}
+	switch p.Body.Kind {
+	case PostMessage, PostRevoke:
+		if p.Body.NewKey != nil || p.KeySignature != nil {
+			return false
+		}
+	case PostRotate:
+		newKey := p.RotatedKey()
+		if newKey == nil || bytes.Equal(p.Body.NewKey, PublicKeyToBytes(p.User)) ||
+			!Verify(newKey, p.Body, p.KeySignature) {
+			return false
+		}
+	default:
+		return false
+	}
 	return Verify(p.User, p.Body, p.Signature)
 }
 
+// RotatedKey - the new key of a PostRotate, or nil if the post is of another kind or its new key cannot be decoded.
+func (p *Post) RotatedKey() *PublicKey {
+	if p.Body.Kind != PostRotate {
+		return nil
+	}
+	newKey, err := PublicKeyFromBytes(p.Body.NewKey)
+	if err != nil {
+		return nil
+	}
+	return newKey
+}
+
+// Size - the number of bytes the Post takes in a block: its public key, content, timestamp, kind, new key and
+// signatures.
+func (p *Post) Size() int {
+	return len(PublicKeyToBytes(p.User)) + len(p.Body.Content) + 8 + 1 + len(p.Body.NewKey) + len(p.Signature) +
+		len(p.KeySignature)
+}
+
+// ID - a short identifier of the Post, used to announce posts to peers without sending them.
+// It covers the user, the body and the signatures, so different posts never share an ID.
+func (p *Post) ID() []byte {
+	hash := sha256.New()
+	user := PublicKeyToBytes(p.User)
+	var buffer [8]byte
+	for _, field := range [][]byte{user, []byte(p.Body.Content), p.Signature, p.Body.NewKey, p.KeySignature} {
+		binary.BigEndian.PutUint64(buffer[:], uint64(len(field)))
+		hash.Write(buffer[:])
+		hash.Write(field)
+	}
+	binary.BigEndian.PutUint64(buffer[:], uint64(p.Body.Timestamp))
+	hash.Write(buffer[:])
+	hash.Write([]byte{byte(p.Body.Kind)})
+	return hash.Sum(nil)
+}
+
 // BlockHeader - Part of Block used to generate the block identity hash (the target of mining).
 type BlockHeader struct {
 	PrevHash  []byte // the identity hash of the previous block in a blockchain
-	Summary   []byte // hash of Posts
+	Summary   []byte // Merkle root of Posts, see MerkleRoot
 	Timestamp int64
 	Nonce     uint32 // miners find the correct Nonce when mining
 }
@@ -38,12 +123,17 @@ type BlockHeader struct {
 // Block - A block in the blockchain
 type Block struct {
 	Header BlockHeader
-	Posts  []Post // all posts contained in this block
+	Posts  []Post     // all posts contained in this block
+	hash   *blockHash // memoised identity hash, see Hash
 }
 
-// Verify - verifies if this block is valid on its own. This does not consider other blocks in the same blockchain.
-func (b *Block) Verify() bool {
-	hash := Hash(b.Header)
+// Verify - verifies if the header's identity hash meets TARGET. This does not need the block's posts.
+func (h *BlockHeader) Verify() bool {
+	return MeetsTarget(h.Hash())
+}
+
+// MeetsTarget - checks whether an identity hash has its first TARGET bits be zero.
+func MeetsTarget(hash []byte) bool {
 	zeroBytes := TARGET / 8
 	zeroBits := TARGET % 8
 	// the first zeroBytes bytes of hash must be zero
@@ -60,26 +150,34 @@ func (b *Block) Verify() bool {
 			return false
 		}
 	}
-	// verify the summary
-	if !bytes.Equal(b.Header.Summary, Hash(b.Posts)) {
-		return false
-	}
-	// verify all posts
+	return true
+}
+
+// Size - the number of bytes taken by the posts of the block, which MaxBlockSize limits.
+func (b *Block) Size() int {
+	size := 0
 	for _, post := range b.Posts {
-		if !post.Verify() {
-			return false
-		}
+		size += post.Size()
 	}
-	return true
+	return size
+}
+
+// Verify - verifies if this block is valid on its own. This does not consider other blocks in the same blockchain.
+// ValidateBlock tells which rule an invalid block breaks.
+func (b *Block) Verify() bool {
+	return ValidateBlock(nil, b) == nil
 }
 
 // PostBase64 - base64-encoded Post to support marshalling to json.
 // It is the same as Post except all []byte are encoded as base64 strings.
 type PostBase64 struct {
-	User      string `json:"user"`
-	Content   string `json:"content"`
-	Timestamp int64  `json:"timestamp"`
-	Signature string `json:"signature"`
+	User         string   `json:"user"`
+	Content      string   `json:"content"`
+	Timestamp    int64    `json:"timestamp"`
+	Signature    string   `json:"signature"`
+	Kind         PostKind `json:"kind,omitempty"`
+	NewKey       string   `json:"new-key,omitempty"`
+	KeySignature string   `json:"key-signature,omitempty"`
 }
 
 // EncodeBase64 - encode a Post to PostBase64.
@@ -89,6 +187,13 @@ func (p *Post) EncodeBase64() PostBase64 {
 		Content:   p.Body.Content,
 		Timestamp: p.Body.Timestamp,
 		Signature: base64.StdEncoding.EncodeToString(p.Signature),
+		Kind:      p.Body.Kind,
+	}
+	if p.Body.NewKey != nil {
+		encoded.NewKey = base64.StdEncoding.EncodeToString(p.Body.NewKey)
+	}
+	if p.KeySignature != nil {
+		encoded.KeySignature = base64.StdEncoding.EncodeToString(p.KeySignature)
 	}
 	return encoded
 }
@@ -99,8 +204,24 @@ func (p *PostBase64) DecodeBase64() (Post, error) {
 		Body: PostBody{
 			Content:   p.Content,
 			Timestamp: p.Timestamp,
+			Kind:      p.Kind,
 		},
 	}
+	// decode the new key and its signature, which only rotations have
+	if p.NewKey != "" {
+		newKey, err := base64.StdEncoding.DecodeString(p.NewKey)
+		if err != nil {
+			return Post{}, err
+		}
+		decoded.Body.NewKey = newKey
+	}
+	if p.KeySignature != "" {
+		keySignature, err := base64.StdEncoding.DecodeString(p.KeySignature)
+		if err != nil {
+			return Post{}, err
+		}
+		decoded.KeySignature = keySignature
+	}
 	// decode public key
 	bytes, err := base64.StdEncoding.DecodeString(p.User)
 	if err != nil {
@@ -137,6 +258,7 @@ func (b *Block) EncodeBase64() BlockBase64 {
 		PrevHash:  base64.StdEncoding.EncodeToString(b.Header.PrevHash),
 		Summary:   base64.StdEncoding.EncodeToString(b.Header.Summary),
 		Timestamp: b.Header.Timestamp,
+		NPosts:    len(b.Posts),
 		Nonce:     b.Header.Nonce,
 	}
 	for _, post := range b.Posts {
@@ -3,15 +3,87 @@ package blockchain
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/binary"
+	"crypto/x509"
 	"encoding/gob"
+	"encoding/pem"
 	"errors"
-	"math/big"
+	"fmt"
 )
 
+// Scheme - A signature scheme that users sign their posts with.
+type Scheme byte
+
+const (
+	// SchemeRSA - RSA PKCS #1 v1.5 with SHA-256 and 2048-bit keys.
+	SchemeRSA Scheme = 1
+	// SchemeEd25519 - Ed25519, the default scheme, which has the smallest keys and signatures and the fastest
+	// verification.
+	SchemeEd25519 Scheme = 2
+	// SchemeECDSA - ECDSA on curve P-256 with SHA-256, with ASN.1-encoded signatures.
+	SchemeECDSA Scheme = 3
+)
+
+// RSAKeySize - Size in bits of newly generated RSA keys.
+const RSAKeySize = 2048
+
+// MinRSAKeySize - Minimum size in bits of the RSA keys that posts may be signed with.
+const MinRSAKeySize = 2048
+
+// ErrWeakKey - A public key is too weak to sign posts with, or is of an unsupported type.
+var ErrWeakKey = errors.New("public key is weak")
+
+// String - the name of the scheme.
+func (s Scheme) String() string {
+	switch s {
+	case SchemeRSA:
+		return "rsa"
+	case SchemeEd25519:
+		return "ed25519"
+	case SchemeECDSA:
+		return "ecdsa-p256"
+	default:
+		return fmt.Sprintf("scheme(%d)", byte(s))
+	}
+}
+
+// PublicKey - A user's public key under one of the signature schemes.
+type PublicKey struct {
+	scheme Scheme
+	key    crypto.PublicKey // *rsa.PublicKey, ed25519.PublicKey or *ecdsa.PublicKey, depending on scheme
+}
+
+// PrivateKey - A user's private key, which also holds its public key.
+type PrivateKey struct {
+	PublicKey
+	signer crypto.Signer // *rsa.PrivateKey, ed25519.PrivateKey or *ecdsa.PrivateKey, depending on scheme
+}
+
+// Scheme - the signature scheme of the key.
+func (k *PublicKey) Scheme() Scheme {
+	return k.scheme
+}
+
+// GobEncode - encodes the key as PublicKeyToBytes does, so that hashes of posts cover their users' keys.
+func (k *PublicKey) GobEncode() ([]byte, error) {
+	return PublicKeyToBytes(k), nil
+}
+
+// GobDecode - decodes a key encoded by GobEncode.
+func (k *PublicKey) GobDecode(buffer []byte) error {
+	decoded, err := PublicKeyFromBytes(buffer)
+	if err != nil {
+		return err
+	}
+	*k = *decoded
+	return nil
+}
+
 // Hash - Hash any object to []byte with sha256 (256 bits).
 func Hash(object any) []byte {
 	// first serialize object to bytes
@@ -27,38 +99,141 @@ func Hash(object any) []byte {
 	return hash[:]
 }
 
-// GenerateKey - Generate a new rsa key pair.
-func GenerateKey() *rsa.PrivateKey {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+// GenerateKey - Generate a new key pair with the default scheme, SchemeEd25519.
+func GenerateKey() *PrivateKey {
+	privateKey, err := GenerateKeyWith(SchemeEd25519)
 	if err != nil {
 		panic(err)
 	}
 	return privateKey
 }
 
-// PublicKeyToBytes - Serialize a public key to []byte.
-func PublicKeyToBytes(publicKey *rsa.PublicKey) []byte {
-	buffer := make([]byte, 4)
-	binary.LittleEndian.PutUint32(buffer, uint32(publicKey.E))
-	buffer = append(buffer, publicKey.N.Bytes()...)
+// GenerateKeyWith - Generate a new key pair with the given signature scheme.
+func GenerateKeyWith(scheme Scheme) (*PrivateKey, error) {
+	var signer crypto.Signer
+	var err error
+	switch scheme {
+	case SchemeRSA:
+		signer, err = rsa.GenerateKey(rand.Reader, RSAKeySize)
+	case SchemeEd25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case SchemeECDSA:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown signature scheme %v", scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{PublicKey: PublicKey{scheme: scheme, key: signer.Public()}, signer: signer}, nil
+}
+
+// PublicKeyToBytes - Serialize a public key to []byte in PKIX, ASN.1 DER form, which also identifies its scheme.
+func PublicKeyToBytes(publicKey *PublicKey) []byte {
+	buffer, err := x509.MarshalPKIXPublicKey(publicKey.key)
+	if err != nil {
+		panic(err)
+	}
+	return buffer
+}
+
+// PublicKeyFromBytes - De-serialize a PKIX, ASN.1 DER public key, and check that it is not weak.
+func PublicKeyFromBytes(buffer []byte) (*PublicKey, error) {
+	key, err := x509.ParsePKIXPublicKey(buffer)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := &PublicKey{key: key}
+	switch key.(type) {
+	case *rsa.PublicKey:
+		publicKey.scheme = SchemeRSA
+	case ed25519.PublicKey:
+		publicKey.scheme = SchemeEd25519
+	case *ecdsa.PublicKey:
+		publicKey.scheme = SchemeECDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+	if err := publicKey.Validate(); err != nil {
+		return nil, err
+	}
+	return publicKey, nil
+}
+
+// PrivateKeyToBytes - Serialize a private key to []byte in PKCS #8, ASN.1 DER form.
+func PrivateKeyToBytes(privateKey *PrivateKey) []byte {
+	buffer, err := x509.MarshalPKCS8PrivateKey(privateKey.signer)
+	if err != nil {
+		panic(err)
+	}
 	return buffer
 }
 
-// PublicKeyFromBytes - De-serialize []byte to a public key.
-func PublicKeyFromBytes(buffer []byte) (*rsa.PublicKey, error) {
-	if len(buffer) <= 4 {
-		return nil, errors.New("input bytes are not long enough")
+// PrivateKeyFromBytes - De-serialize a PKCS #8, ASN.1 DER private key, and check that its public key is not weak.
+func PrivateKeyFromBytes(buffer []byte) (*PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(buffer)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	publicKey, err := PublicKeyFromBytes(PublicKeyToBytes(&PublicKey{key: signer.Public()}))
+	if err != nil {
+		return nil, err
+	}
+	return &PrivateKey{PublicKey: *publicKey, signer: signer}, nil
+}
+
+// PublicKeyToPEM - Serialize a public key to a PEM block of type "PUBLIC KEY".
+func PublicKeyToPEM(publicKey *PublicKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: PublicKeyToBytes(publicKey)})
+}
+
+// PublicKeyFromPEM - De-serialize the first PEM block of type "PUBLIC KEY" to a public key.
+func PublicKeyFromPEM(buffer []byte) (*PublicKey, error) {
+	block, _ := pem.Decode(buffer)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("input bytes are not a PEM-encoded public key")
+	}
+	return PublicKeyFromBytes(block.Bytes)
+}
+
+// Validate - Checks that the key is strong enough to sign posts with: RSA keys must have at least MinRSAKeySize bits and
+// an odd exponent of at least 3, and ECDSA keys must be on curve P-256. Errors wrap ErrWeakKey.
+func (k *PublicKey) Validate() error {
+	switch key := k.key.(type) {
+	case *rsa.PublicKey:
+		if key.N == nil || key.N.BitLen() < MinRSAKeySize {
+			return fmt.Errorf("%w: RSA modulus is shorter than %d bits", ErrWeakKey, MinRSAKeySize)
+		}
+		if key.E < 3 || key.E%2 == 0 {
+			return fmt.Errorf("%w: RSA exponent %d is not an odd number of at least 3", ErrWeakKey, key.E)
+		}
+	case ed25519.PublicKey:
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: Ed25519 key is not %d bytes", ErrWeakKey, ed25519.PublicKeySize)
+		}
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return fmt.Errorf("%w: ECDSA key is not on curve P-256", ErrWeakKey)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported public key type %T", ErrWeakKey, key)
 	}
-	E := int(binary.LittleEndian.Uint32(buffer[:4]))
-	N := new(big.Int)
-	N.SetBytes(buffer[4:])
-	return &rsa.PublicKey{N: N, E: E}, nil
+	return nil
 }
 
 // Sign - Sign an arbitrary object with a private key.
-func Sign(privateKey *rsa.PrivateKey, object any) []byte {
+func Sign(privateKey *PrivateKey, object any) []byte {
 	hash := Hash(object)
-	signature, err := rsa.SignPKCS1v15(nil, privateKey, crypto.SHA256, hash)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if privateKey.scheme == SchemeEd25519 {
+		// Ed25519 signs the hash as a message
+		opts = crypto.Hash(0)
+	}
+	signature, err := privateKey.signer.Sign(rand.Reader, hash, opts)
 	if err != nil {
 		panic(err)
 	}
@@ -66,8 +241,19 @@ func Sign(privateKey *rsa.PrivateKey, object any) []byte {
 }
 
 // Verify - Checks whether the signature is produced by signing object with the public key's private key.
-func Verify(publicKey *rsa.PublicKey, object any, signature []byte) bool {
+func Verify(publicKey *PublicKey, object any, signature []byte) bool {
+	if publicKey == nil || publicKey.Validate() != nil {
+		return false
+	}
 	hash := Hash(object)
-	err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, hash, signature)
-	return err == nil
+	switch key := publicKey.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, hash, signature)
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, hash, signature)
+	default:
+		return false
+	}
 }
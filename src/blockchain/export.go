@@ -0,0 +1,321 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ExportMagic - The first bytes of every chain export.
+const ExportMagic = "POWCHAIN"
+
+// ExportVersion - Version of the chain export format that ExportChain writes and ImportChain reads.
+const ExportVersion = 1
+
+// MaxImportBlocks - ImportChain refuses an export that declares more blocks than this, before reading any of them.
+const MaxImportBlocks = 1 << 20
+
+// maxEncodedBlock - the longest canonical encoding of a valid block: its posts, the length prefixes of their fields,
+// and its header.
+const maxEncodedBlock = MaxBlockSize + MaxBlockPosts*32 + 256
+
+// ErrExportFormat - The input is not a well-formed chain export.
+var ErrExportFormat = errors.New("malformed chain export")
+
+// ErrExportVersion - The chain export was written in a version of the format that ImportChain does not read.
+var ErrExportVersion = errors.New("unsupported chain export version")
+
+// ErrExportNetwork - The chain export holds the blockchain of another network.
+var ErrExportNetwork = errors.New("chain export is of another network")
+
+// ErrExportChecksum - The chain export does not match its checksum, so it was corrupted or cut short.
+var ErrExportChecksum = errors.New("chain export does not match its checksum")
+
+// EncodeBinary - the canonical encoding of a Block: its header, then each of its posts, with every byte slice prefixed
+// by its length. Equal blocks always have the same encoding.
+func (b *Block) EncodeBinary() []byte {
+	var buffer bytes.Buffer
+	putBytes(&buffer, b.Header.PrevHash)
+	putBytes(&buffer, b.Header.Summary)
+	putUint64(&buffer, uint64(b.Header.Timestamp))
+	putUint32(&buffer, b.Header.Nonce)
+	putUint32(&buffer, uint32(len(b.Posts)))
+	for _, post := range b.Posts {
+		putPost(&buffer, &post)
+	}
+	return buffer.Bytes()
+}
+
+// putPost - writes the canonical encoding of a post: its user, content, timestamp, kind, new key and signatures.
+func putPost(buffer *bytes.Buffer, post *Post) {
+	putBytes(buffer, PublicKeyToBytes(post.User))
+	putBytes(buffer, []byte(post.Body.Content))
+	putUint64(buffer, uint64(post.Body.Timestamp))
+	buffer.WriteByte(byte(post.Body.Kind))
+	putBytes(buffer, post.Body.NewKey)
+	putBytes(buffer, post.Signature)
+	putBytes(buffer, post.KeySignature)
+}
+
+// DecodeBinary - decode the canonical encoding of a Block, as EncodeBinary writes it.
+func DecodeBinary(data []byte) (Block, error) {
+	d := decoder{data: data}
+	block := Block{
+		Header: BlockHeader{
+			PrevHash:  d.bytes(),
+			Summary:   d.bytes(),
+			Timestamp: int64(d.uint64()),
+			Nonce:     d.uint32(),
+		},
+	}
+	count := d.uint32()
+	if count > MaxBlockPosts {
+		return Block{}, fmt.Errorf("%w: block holds %d posts", ErrExportFormat, count)
+	}
+	for i := uint32(0); i < count && d.err == nil; i++ {
+		user := d.bytes()
+		post := Post{
+			Body: PostBody{
+				Content:   string(d.bytes()),
+				Timestamp: int64(d.uint64()),
+				Kind:      PostKind(d.byte()),
+				NewKey:    d.optionalBytes(),
+			},
+			Signature:    d.bytes(),
+			KeySignature: d.optionalBytes(),
+		}
+		if d.err != nil {
+			break
+		}
+		publicKey, err := PublicKeyFromBytes(user)
+		if err != nil {
+			return Block{}, err
+		}
+		post.User = publicKey
+		block.Posts = append(block.Posts, post)
+	}
+	if d.err == nil && len(d.data) > 0 {
+		d.err = fmt.Errorf("%w: %d bytes after the block", ErrExportFormat, len(d.data))
+	}
+	if d.err != nil {
+		return Block{}, d.err
+	}
+	return block, nil
+}
+
+// ExportChain - writes chain, a blockchain of network, to w in the chain export format: ExportMagic, ExportVersion, the
+// network's genesis hash and the number of blocks, then the canonical encoding of each block prefixed by its length,
+// and last the SHA-256 hash of everything before it. Integers are big-endian.
+func ExportChain(w io.Writer, network *Network, chain []Block) error {
+	buffered := bufio.NewWriter(w)
+	checksum := sha256.New()
+	out := io.MultiWriter(buffered, checksum)
+	var header bytes.Buffer
+	header.WriteString(ExportMagic)
+	putUint32(&header, ExportVersion)
+	header.Write(network.GenesisHash())
+	putUint64(&header, uint64(len(chain)))
+	if _, err := out.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for _, block := range chain {
+		var prefix bytes.Buffer
+		encoded := block.EncodeBinary()
+		putUint32(&prefix, uint32(len(encoded)))
+		if _, err := out.Write(prefix.Bytes()); err != nil {
+			return err
+		}
+		if _, err := out.Write(encoded); err != nil {
+			return err
+		}
+	}
+	if _, err := buffered.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+// ImportChain - reads a blockchain that ExportChain wrote, and validates it with the rules of ValidateChain and options
+// as it is read, so that an invalid export fails at its first invalid block rather than once all of it is in memory.
+// options.Network, MainNetwork if nil, must be the network that the blockchain was exported from.
+// Returns ErrExportFormat, ErrExportVersion, ErrExportNetwork or ErrExportChecksum if the input cannot be read as the
+// network's blockchain, or the *ValidationError of the first consensus rule that the blockchain breaks.
+func ImportChain(r io.Reader, options ValidateOptions) ([]Block, error) {
+	network := options.Network
+	if network == nil {
+		network = &MainNetwork
+	}
+	checksum := sha256.New()
+	in := &checksumReader{reader: bufio.NewReader(r), checksum: checksum}
+	magic := make([]byte, len(ExportMagic))
+	if _, err := io.ReadFull(in, magic); err != nil || string(magic) != ExportMagic {
+		return nil, fmt.Errorf("%w: missing magic", ErrExportFormat)
+	}
+	header := make([]byte, 4+sha256.Size+8)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return nil, fmt.Errorf("%w: header is cut short", ErrExportFormat)
+	}
+	if version := binary.BigEndian.Uint32(header); version != ExportVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrExportVersion, version)
+	}
+	if !bytes.Equal(header[4:4+sha256.Size], network.GenesisHash()) {
+		return nil, ErrExportNetwork
+	}
+	count := binary.BigEndian.Uint64(header[4+sha256.Size:])
+	if count > MaxImportBlocks {
+		return nil, fmt.Errorf("%w: %d blocks are more than %d", ErrExportFormat, count, MaxImportBlocks)
+	}
+	options.Network = network
+	chain := make([]Block, 0)
+	seen := make(map[string]bool)
+	for height := uint64(0); height < count; height++ {
+		var prefix [4]byte
+		if _, err := io.ReadFull(in, prefix[:]); err != nil {
+			return nil, fmt.Errorf("%w: block at height %d is missing", ErrExportFormat, height)
+		}
+		size := binary.BigEndian.Uint32(prefix[:])
+		if size > maxEncodedBlock {
+			return nil, fmt.Errorf("%w: block at height %d takes %d bytes", ErrExportFormat, height, size)
+		}
+		encoded := make([]byte, size)
+		if _, err := io.ReadFull(in, encoded); err != nil {
+			return nil, fmt.Errorf("%w: block at height %d is cut short", ErrExportFormat, height)
+		}
+		block, err := DecodeBinary(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("block at height %d: %w", height, err)
+		}
+		chain = append(chain, block)
+		if err := validateLast(chain, seen, options); err != nil {
+			return nil, err
+		}
+	}
+	// the checksum itself is not part of what it covers
+	expected := checksum.Sum(nil)
+	actual := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(in.reader, actual); err != nil || !bytes.Equal(actual, expected) {
+		return nil, ErrExportChecksum
+	}
+	if n, _ := in.reader.Read(make([]byte, 1)); n > 0 {
+		return nil, fmt.Errorf("%w: data after the checksum", ErrExportFormat)
+	}
+	return chain, nil
+}
+
+// validateLast - checks the last block of chain, whose other blocks have been checked, with the rules that
+// ValidateChain and options would check it with as part of the whole chain: on its own and against the blocks before
+// it, to which it must link. seen holds the posts of the other blocks, and those of the last block are added to it.
+func validateLast(chain []Block, seen map[string]bool, options ValidateOptions) error {
+	height := len(chain) - 1
+	options.Start = height
+	options.Prev = chain[max(height-MedianTimeSpan, 0):height]
+	if err := ValidateChain(chain[height:], options); err != nil {
+		return err
+	}
+	block := &chain[height]
+	if height > 0 && !bytes.Equal(block.Header.PrevHash, chain[height-1].Hash()) {
+		return &ValidationError{Rule: RuleLinkage, Height: height, Post: -1}
+	}
+	for i, post := range block.Posts {
+		key := postKey(&post)
+		if seen[key] {
+			return &ValidationError{Rule: RuleDuplicatePost, Height: height, Post: i}
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// checksumReader - a reader that hashes everything read through it.
+type checksumReader struct {
+	reader   *bufio.Reader
+	checksum hash.Hash
+}
+
+// Read - reads from the underlying reader, and adds what was read to the checksum.
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.checksum.Write(p[:n])
+	return n, err
+}
+
+// putBytes - writes data prefixed by its length.
+func putBytes(buffer *bytes.Buffer, data []byte) {
+	putUint32(buffer, uint32(len(data)))
+	buffer.Write(data)
+}
+
+// putUint32 - writes a big-endian uint32.
+func putUint32(buffer *bytes.Buffer, value uint32) {
+	buffer.Write(binary.BigEndian.AppendUint32(nil, value))
+}
+
+// putUint64 - writes a big-endian uint64.
+func putUint64(buffer *bytes.Buffer, value uint64) {
+	buffer.Write(binary.BigEndian.AppendUint64(nil, value))
+}
+
+// decoder - reads the fields of a canonical encoding one after another. After the first error, which is kept in err,
+// every read returns zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+// take - the next n bytes of data.
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = fmt.Errorf("%w: block is cut short", ErrExportFormat)
+		return nil
+	}
+	taken := d.data[:n]
+	d.data = d.data[n:]
+	return taken
+}
+
+// bytes - a copy of the next byte slice, which is prefixed by its length.
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	return bytes.Clone(d.take(int(n)))
+}
+
+// optionalBytes - like bytes, but an empty byte slice is decoded as nil, as fields that only some posts have are.
+func (d *decoder) optionalBytes() []byte {
+	data := d.bytes()
+	if len(data) == 0 {
+		return nil
+	}
+	return data
+}
+
+// byte - the next byte.
+func (d *decoder) byte() byte {
+	if taken := d.take(1); taken != nil {
+		return taken[0]
+	}
+	return 0
+}
+
+// uint32 - the next big-endian uint32.
+func (d *decoder) uint32() uint32 {
+	if taken := d.take(4); taken != nil {
+		return binary.BigEndian.Uint32(taken)
+	}
+	return 0
+}
+
+// uint64 - the next big-endian uint64.
+func (d *decoder) uint64() uint64 {
+	if taken := d.take(8); taken != nil {
+		return binary.BigEndian.Uint64(taken)
+	}
+	return 0
+}
@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"sync"
+)
+
+// headerType - the gob type definition of BlockHeader, which a fresh gob encoder sends before the first header.
+// Hash(header) is the SHA-256 hash of headerType followed by the gob encoding of the header's value.
+var headerType []byte
+
+// headerEncoders - pool of headerEncoder, which are expensive to warm up.
+var headerEncoders = sync.Pool{New: func() any { return newHeaderEncoder() }}
+
+// headerEncoder - a gob encoder that has already sent headerType, so that it only encodes the values of headers.
+type headerEncoder struct {
+	buffer  bytes.Buffer
+	encoder *gob.Encoder
+}
+
+func init() {
+	// the type definition is what a fresh encoder sends in addition to the value of a header
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(BlockHeader{}); err != nil {
+		panic(err)
+	}
+	first := bytes.Clone(buffer.Bytes())
+	buffer.Reset()
+	if err := encoder.Encode(BlockHeader{}); err != nil {
+		panic(err)
+	}
+	headerType = first[:len(first)-buffer.Len()]
+}
+
+// newHeaderEncoder - creates a headerEncoder, and warms it up by encoding a header whose output is discarded.
+func newHeaderEncoder() *headerEncoder {
+	e := &headerEncoder{}
+	e.encoder = gob.NewEncoder(&e.buffer)
+	if err := e.encoder.Encode(BlockHeader{}); err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// Hash - the identity hash of the header, which is equal to Hash(header) but several times faster to compute, since it
+// skips registering and describing the BlockHeader type to gob. Miners call it in their inner loop.
+func (h *BlockHeader) Hash() []byte {
+	e := headerEncoders.Get().(*headerEncoder)
+	defer headerEncoders.Put(e)
+	e.buffer.Reset()
+	if err := e.encoder.Encode(h); err != nil {
+		panic(err)
+	}
+	hash := sha256.New()
+	hash.Write(headerType)
+	hash.Write(e.buffer.Bytes())
+	return hash.Sum(nil)
+}
+
+// clone - a deep copy of the header.
+func (h *BlockHeader) clone() BlockHeader {
+	return BlockHeader{
+		PrevHash:  bytes.Clone(h.PrevHash),
+		Summary:   bytes.Clone(h.Summary),
+		Timestamp: h.Timestamp,
+		Nonce:     h.Nonce,
+	}
+}
+
+// equal - checks whether two headers have the same content.
+func (h *BlockHeader) equal(other *BlockHeader) bool {
+	return h.Timestamp == other.Timestamp && h.Nonce == other.Nonce && bytes.Equal(h.PrevHash, other.PrevHash) &&
+		bytes.Equal(h.Summary, other.Summary)
+}
+
+// blockHash - a memoised identity hash, with a copy of the header it was computed from.
+type blockHash struct {
+	header BlockHeader
+	hash   []byte
+}
+
+// Hash - the identity hash of the block's header. It is computed once and memoised in the block, and computed again
+// only if the header has changed since. Like other writes to a block, the first call must not race with other uses of
+// the block; readers that share a block should only call it once its hash is memoised.
+func (b *Block) Hash() []byte {
+	if memo := b.hash; memo != nil && memo.header.equal(&b.Header) {
+		return bytes.Clone(memo.hash)
+	}
+	hash := b.Header.Hash()
+	b.hash = &blockHash{header: b.Header.clone(), hash: hash}
+	return bytes.Clone(hash)
+}
+
+// VerifyHeader - verifies if the block's identity hash meets TARGET, like Header.Verify, but memoises the hash.
+func (b *Block) VerifyHeader() bool {
+	return MeetsTarget(b.Hash())
+}
@@ -0,0 +1,157 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// merkleLeafPrefix, merkleNodePrefix, merkleRootPrefix - Leaves, inner nodes and the root of a Merkle tree are hashed
+// with different prefixes, so that none of them can pass for another.
+const (
+	merkleLeafPrefix byte = 0
+	merkleNodePrefix byte = 1
+	merkleRootPrefix byte = 2
+)
+
+// MerkleRoot - the root of the Merkle tree of posts, which is the Summary of a block that holds them. Each leaf is the
+// hash of a post's canonical encoding, as EncodeBinary writes it, and each inner node is the hash of its two children.
+// A node without a sibling is carried up to the next level as it is. The root is the hash of the number of posts and
+// the top node of the tree, so that the summary commits to where the tree ends. The root of no posts is the hash of
+// nothing.
+func MerkleRoot(posts []Post) []byte {
+	if len(posts) == 0 {
+		hash := sha256.Sum256(nil)
+		return hash[:]
+	}
+	level := make([][]byte, 0, len(posts))
+	for i := range posts {
+		level = append(level, merkleLeaf(&posts[i]))
+	}
+	for len(level) > 1 {
+		level = merkleLevel(level)
+	}
+	return merkleTop(len(posts), level[0])
+}
+
+// merkleTop - the root of a Merkle tree of count posts whose top node is top.
+func merkleTop(count int, top []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte(merkleRootPrefix)
+	putUint32(&buffer, uint32(count))
+	buffer.Write(top)
+	hash := sha256.Sum256(buffer.Bytes())
+	return hash[:]
+}
+
+// merkleLeaf - the leaf of a post in a Merkle tree.
+func merkleLeaf(post *Post) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteByte(merkleLeafPrefix)
+	putPost(&buffer, post)
+	hash := sha256.Sum256(buffer.Bytes())
+	return hash[:]
+}
+
+// merkleNode - the inner node of a Merkle tree whose children are left and right.
+func merkleNode(left []byte, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// merkleLevel - the level of a Merkle tree above level.
+func merkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i+1 < len(level); i += 2 {
+		next = append(next, merkleNode(level[i], level[i+1]))
+	}
+	if len(level)%2 == 1 {
+		next = append(next, level[len(level)-1])
+	}
+	return next
+}
+
+// MerkleProof - Proves that a post is in a block by its Summary alone, so that light clients need not download the
+// other posts of the block.
+type MerkleProof struct {
+	Index    int      // index of the post in the block
+	Count    int      // number of posts in the block
+	Siblings [][]byte // siblings of the nodes on the path from the post's leaf to the root, from the leaf up
+}
+
+// Prove - the proof that the post at index is in the block, or false if the block holds no post at index.
+func (b *Block) Prove(index int) (MerkleProof, bool) {
+	if index < 0 || index >= len(b.Posts) {
+		return MerkleProof{}, false
+	}
+	proof := MerkleProof{Index: index, Count: len(b.Posts), Siblings: make([][]byte, 0)}
+	level := make([][]byte, 0, len(b.Posts))
+	for i := range b.Posts {
+		level = append(level, merkleLeaf(&b.Posts[i]))
+	}
+	for ; len(level) > 1; index /= 2 {
+		// nodes carried up without a sibling add nothing to the proof
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling])
+		}
+		level = merkleLevel(level)
+	}
+	return proof, true
+}
+
+// Verify - verifies that post is the post at p.Index of a block of p.Count posts whose Summary is summary. Since the
+// summary commits to the number of posts, no proof for another count matches it.
+func (p *MerkleProof) Verify(post *Post, summary []byte) bool {
+	if p.Count <= 0 || p.Count > MaxBlockPosts || p.Index < 0 || p.Index >= p.Count {
+		return false
+	}
+	node := merkleLeaf(post)
+	siblings := p.Siblings
+	for index, count := p.Index, p.Count; count > 1; index, count = index/2, (count+1)/2 {
+		if index^1 >= count {
+			continue
+		}
+		if len(siblings) == 0 {
+			return false
+		}
+		if index%2 == 0 {
+			node = merkleNode(node, siblings[0])
+		} else {
+			node = merkleNode(siblings[0], node)
+		}
+		siblings = siblings[1:]
+	}
+	return len(siblings) == 0 && bytes.Equal(merkleTop(p.Count, node), summary)
+}
+
+// MerkleProofBase64 - base64-encoded MerkleProof to support marshalling to json.
+type MerkleProofBase64 struct {
+	Index    int      `json:"index"`
+	Count    int      `json:"count"`
+	Siblings []string `json:"siblings"`
+}
+
+// EncodeBase64 - encode a MerkleProof to a MerkleProofBase64.
+func (p *MerkleProof) EncodeBase64() MerkleProofBase64 {
+	encoded := MerkleProofBase64{Index: p.Index, Count: p.Count, Siblings: make([]string, 0, len(p.Siblings))}
+	for _, sibling := range p.Siblings {
+		encoded.Siblings = append(encoded.Siblings, base64.StdEncoding.EncodeToString(sibling))
+	}
+	return encoded
+}
+
+// DecodeBase64 - decode a MerkleProofBase64 to a MerkleProof.
+func (p *MerkleProofBase64) DecodeBase64() (MerkleProof, error) {
+	decoded := MerkleProof{Index: p.Index, Count: p.Count, Siblings: make([][]byte, 0, len(p.Siblings))}
+	for _, encoded := range p.Siblings {
+		sibling, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return MerkleProof{}, err
+		}
+		decoded.Siblings = append(decoded.Siblings, sibling)
+	}
+	return decoded, nil
+}
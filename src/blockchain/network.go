@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+// Network - A blockchain network. Every chain of a network starts from its genesis block, which commits to the
+// network's name, magic number and consensus parameters, so chains of different networks can never be mixed.
+type Network struct {
+	Name        string         // human-readable name of the network
+	Magic       uint32         // tells apart networks that share a name, such as independent test networks
+	Timestamp   int64          // timestamp of the genesis block
+	Checkpoints map[int]string // hex-encoded identity hashes of the blocks that every chain has at some heights
+}
+
+// MainNetwork - The network that nodes join unless they are configured with another one.
+var MainNetwork = Network{Name: "main", Magic: 0xd9b4bef9, Timestamp: 1714521600000000000}
+
+// genesisParameters - the content of a genesis block, whose hash is the genesis block's Summary.
+type genesisParameters struct {
+	Name           string
+	Magic          uint32
+	Target         int
+	MaxContentSize int
+	MaxBlockSize   int
+	MaxBlockPosts  int
+}
+
+// Genesis - the genesis block of the network. It is not mined and holds no posts; the first mined block of every chain
+// of the network links to it. Genesis blocks are never sent between nodes, since every node can build them.
+func (n *Network) Genesis() Block {
+	parameters := genesisParameters{
+		Name:           n.Name,
+		Magic:          n.Magic,
+		Target:         TARGET,
+		MaxContentSize: MaxContentSize,
+		MaxBlockSize:   MaxBlockSize,
+		MaxBlockPosts:  MaxBlockPosts,
+	}
+	return Block{
+		Header: BlockHeader{
+			PrevHash:  make([]byte, 32),
+			Summary:   Hash(parameters),
+			Timestamp: n.Timestamp,
+		},
+		Posts: []Post{},
+	}
+}
+
+// GenesisHash - the identity hash of the network's genesis block, which is the PrevHash of the first mined block.
+func (n *Network) GenesisHash() []byte {
+	genesis := n.Genesis()
+	return genesis.Header.Hash()
+}
+
+// ID - the network ID that nodes exchange to refuse peers of other networks: the hex-encoded genesis hash.
+func (n *Network) ID() string {
+	return hex.EncodeToString(n.GenesisHash())
+}
+
+// VerifyCheckpoints - finds the first block of chain that contradicts one of the network's checkpoints, and returns
+// its height, or -1 if chain agrees with every checkpoint it is long enough to reach.
+func (n *Network) VerifyCheckpoints(chain []Block) int {
+	return n.verifyCheckpoints(chain, 0)
+}
+
+// verifyCheckpoints - VerifyCheckpoints for the blocks of a chain from height start on.
+func (n *Network) verifyCheckpoints(blocks []Block, start int) int {
+	heights := make([]int, 0, len(n.Checkpoints))
+	for height := range n.Checkpoints {
+		if height >= start && height < start+len(blocks) {
+			heights = append(heights, height)
+		}
+	}
+	sort.Ints(heights)
+	for _, height := range heights {
+		if hex.EncodeToString(blocks[height-start].Hash()) != n.Checkpoints[height] {
+			return height
+		}
+	}
+	return -1
+}
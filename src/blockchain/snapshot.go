@@ -0,0 +1,126 @@
+package blockchain
+
+import "bytes"
+
+// Prune - a copy of the block with its header but without its posts, as miners keep old blocks once they prune them.
+// The identity hash of the block is kept, memoised or not.
+func (b *Block) Prune() Block {
+	return Block{Header: b.Header, hash: b.hash}
+}
+
+// IsPruned - checks whether the block lacks the posts that its summary covers, as pruned blocks do.
+func (b *Block) IsPruned() bool {
+	return len(b.Posts) == 0 && !bytes.Equal(b.Header.Summary, MerkleRoot(b.Posts))
+}
+
+// Stub - a copy of the post with only its user and timestamp, which are what no two posts of a blockchain share.
+// Miners keep stubs of the posts of pruned blocks, so that new posts are still told from old ones.
+func (p *Post) Stub() Post {
+	return Post{User: p.User, Body: PostBody{Timestamp: p.Body.Timestamp}}
+}
+
+// Snapshot - The state derived from the blocks of a blockchain below a height: their headers, and stubs of their posts.
+// A miner that loads a snapshot continues the blockchain from its height with the posts of the later blocks only. The
+// blockchain has no accounts, so there are no balances to keep.
+type Snapshot struct {
+	Headers []BlockHeader // headers of the blocks below the snapshot's height, from height 0
+	Posts   []Post        // stubs of the posts of those blocks, as Post.Stub makes them
+}
+
+// Height - the height of the first block after the snapshot.
+func (s *Snapshot) Height() int {
+	return len(s.Headers)
+}
+
+// Blocks - the pruned blocks of the snapshot, which hold their headers only.
+func (s *Snapshot) Blocks() []Block {
+	blocks := make([]Block, len(s.Headers))
+	for i, header := range s.Headers {
+		blocks[i] = Block{Header: header}
+	}
+	return blocks
+}
+
+// Verify - checks the headers of the snapshot with ValidateChain and options, from height 0 with every block pruned,
+// and that its post stubs have valid keys, are not duplicated, are no more than its blocks can hold, and are not dated
+// after its last block could include them. The post stubs cannot be checked against the headers beyond that, so a
+// snapshot must come from a trusted miner.
+// Returns nil, or a *ValidationError for the first rule found broken; errors about post stubs have a Height of -1 and
+// the index of the stub as Post.
+func (s *Snapshot) Verify(options ValidateOptions) error {
+	options.Start = 0
+	options.Pruned = s.Height()
+	if err := ValidateChain(s.Blocks(), options); err != nil {
+		return err
+	}
+	if len(s.Posts) > s.Height()*MaxBlockPosts {
+		return &ValidationError{Rule: RuleBlockSize, Height: -1, Post: -1}
+	}
+	latest := int64(0)
+	for _, header := range s.Headers {
+		latest = max(latest, header.Timestamp)
+	}
+	seen := make(map[string]bool)
+	for i, post := range s.Posts {
+		if post.User == nil || post.User.Validate() != nil {
+			return &ValidationError{Rule: RuleWeakKey, Height: -1, Post: i}
+		}
+		if post.Body.Timestamp > latest+int64(MaxFutureDrift) {
+			return &ValidationError{Rule: RulePostTime, Height: -1, Post: i}
+		}
+		key := postKey(&post)
+		if seen[key] {
+			return &ValidationError{Rule: RuleDuplicatePost, Height: -1, Post: i}
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// SnapshotBase64 - base64-encoded Snapshot to support marshalling to json.
+// Headers are encoded as blocks without posts, and post stubs as posts without content or signature.
+type SnapshotBase64 struct {
+	Headers []BlockBase64 `json:"headers"`
+	Posts   []PostBase64  `json:"posts"`
+}
+
+// EncodeBase64 - encode a Snapshot to a SnapshotBase64.
+func (s *Snapshot) EncodeBase64() SnapshotBase64 {
+	encoded := SnapshotBase64{
+		Headers: make([]BlockBase64, 0, len(s.Headers)),
+		Posts:   make([]PostBase64, 0, len(s.Posts)),
+	}
+	for _, header := range s.Headers {
+		block := Block{Header: header}
+		encoded.Headers = append(encoded.Headers, block.EncodeBase64())
+	}
+	for _, post := range s.Posts {
+		encoded.Posts = append(encoded.Posts, post.EncodeBase64())
+	}
+	return encoded
+}
+
+// DecodeBase64 - decode a SnapshotBase64 to a Snapshot. Posts of the encoded headers are ignored, and only the users
+// and timestamps of the encoded posts are kept.
+func (s *SnapshotBase64) DecodeBase64() (Snapshot, error) {
+	decoded := Snapshot{
+		Headers: make([]BlockHeader, 0, len(s.Headers)),
+		Posts:   make([]Post, 0, len(s.Posts)),
+	}
+	for _, encoded := range s.Headers {
+		encoded.Posts = nil
+		block, err := encoded.DecodeBase64()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		decoded.Headers = append(decoded.Headers, block.Header)
+	}
+	for _, encoded := range s.Posts {
+		post, err := encoded.DecodeBase64()
+		if err != nil {
+			return Snapshot{}, err
+		}
+		decoded.Posts = append(decoded.Posts, post.Stub())
+	}
+	return decoded, nil
+}
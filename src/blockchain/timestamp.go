@@ -0,0 +1,50 @@
+package blockchain
+
+import (
+	"sort"
+	"time"
+)
+
+// MedianTimeSpan - A valid block's timestamp is greater than the median timestamp of the MedianTimeSpan blocks
+// before it.
+const MedianTimeSpan = 11
+
+// MaxFutureDrift - A block or post is not accepted while its timestamp is more than MaxFutureDrift ahead of the
+// receiver's clock.
+const MaxFutureDrift = 2 * time.Minute
+
+// PostTimeWindow - A valid block only includes posts whose timestamps are at most PostTimeWindow before the block's
+// own timestamp, and at most MaxFutureDrift after it.
+const PostTimeWindow = time.Hour
+
+// VerifyTime - verifies the Post's timestamp is within the window allowed for a block with timestamp blockTime.
+func (p *Post) VerifyTime(blockTime int64) bool {
+	return p.Body.Timestamp >= blockTime-int64(PostTimeWindow) && p.Body.Timestamp <= blockTime+int64(MaxFutureDrift)
+}
+
+// MedianTimePast - the median timestamp of the last MedianTimeSpan blocks of chain, or 0 if chain is empty.
+func MedianTimePast(chain []Block) int64 {
+	if len(chain) > MedianTimeSpan {
+		chain = chain[len(chain)-MedianTimeSpan:]
+	}
+	if len(chain) == 0 {
+		return 0
+	}
+	timestamps := make([]int64, len(chain))
+	for i, block := range chain {
+		timestamps[i] = block.Header.Timestamp
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
+
+// VerifyTime - verifies the block's timestamp is greater than the median time of prev, the blocks before it in its
+// blockchain, and not more than MaxFutureDrift ahead of now.
+func (b *Block) VerifyTime(prev []Block, now time.Time) bool {
+	if len(prev) > 0 && b.Header.Timestamp <= MedianTimePast(prev) {
+		return false
+	}
+	return b.Header.Timestamp <= now.Add(MaxFutureDrift).UnixNano()
+}
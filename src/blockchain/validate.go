@@ -0,0 +1,220 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// Rule - A consensus rule that blocks and blockchains must follow. Rules are errors, so that errors.Is tells which rule
+// a ValidationError is about.
+type Rule string
+
+const (
+	// RuleProofOfWork - A block's identity hash meets TARGET.
+	RuleProofOfWork Rule = "proof-of-work"
+	// RuleBlockSize - A block holds at most MaxBlockPosts posts, which take at most MaxBlockSize bytes.
+	RuleBlockSize Rule = "block-size"
+	// RuleSummary - A block's Summary is the Merkle root of its posts.
+	RuleSummary Rule = "summary"
+	// RuleFuture - A block's timestamp is at most MaxFutureDrift ahead of the receiver's clock.
+	RuleFuture Rule = "future"
+	// RuleBlockTime - A block's timestamp is greater than the median time of the blocks before it.
+	RuleBlockTime Rule = "block-time"
+	// RuleContentSize - A post's content is at most MaxContentSize bytes long.
+	RuleContentSize Rule = "content-size"
+	// RulePostTime - A post's timestamp is within the window that Post.VerifyTime allows for its block.
+	RulePostTime Rule = "post-time"
+	// RuleWeakKey - A post's user key passes PublicKey.Validate.
+	RuleWeakKey Rule = "weak-key"
+	// RuleSignature - A post is signed as Post.Verify requires.
+	RuleSignature Rule = "signature"
+	// RuleGenesis - The first block of a blockchain links to its network's genesis block.
+	RuleGenesis Rule = "genesis"
+	// RuleLinkage - Every other block links to the identity hash of the block before it.
+	RuleLinkage Rule = "linkage"
+	// RuleCheckpoint - A blockchain has the blocks that its network's checkpoints name at their heights.
+	RuleCheckpoint Rule = "checkpoint"
+	// RuleDuplicatePost - No two posts of a blockchain share a user and a timestamp.
+	RuleDuplicatePost Rule = "duplicate-post"
+	// RulePrunedPosts - A block below the pruned height holds no posts, since they could not be checked.
+	RulePrunedPosts Rule = "pruned-posts"
+)
+
+// Error - describes the rule as a broken one.
+func (r Rule) Error() string {
+	return fmt.Sprintf("%s rule is broken", string(r))
+}
+
+// ValidationError - The first consensus rule that a blockchain or block was found to break, and where.
+type ValidationError struct {
+	Rule   Rule
+	Height int // height of the block that breaks the rule, or -1 if it was checked on its own or is a Snapshot's post stub
+	Post   int // index in the block of the post that breaks the rule, or -1 if the rule is about the block
+}
+
+// Error - describes the rule that was broken and where.
+func (e *ValidationError) Error() string {
+	where := "block"
+	if e.Height >= 0 {
+		where = fmt.Sprintf("block at height %d", e.Height)
+	}
+	if e.Post >= 0 {
+		where = fmt.Sprintf("post %d of %s", e.Post, where)
+	}
+	return fmt.Sprintf("%s breaks the %s rule", where, string(e.Rule))
+}
+
+// Unwrap - the rule that was broken.
+func (e *ValidationError) Unwrap() error {
+	return e.Rule
+}
+
+// ValidateOptions - Where the blocks that ValidateChain checks come from.
+type ValidateOptions struct {
+	Network *Network     // network whose genesis block and checkpoints the blocks must agree with, MainNetwork if nil
+	Start   int          // height of the first block; the first block's link is only checked at height 0
+	Prev    []Block      // blocks right below Start, whose timestamps the first blocks' median time past includes
+	Now     time.Time    // the receiver's clock; block timestamps are not checked if it is zero
+	Cache   *VerifyCache // posts that have been verified before, as in VerifyPosts; may be nil
+	Partial bool         // blocks may hold only some of their posts, as reads filtered by author or time return them
+	Pruned  int          // height below which blocks have been pruned, so that only their headers are checked
+}
+
+// ValidateBlock - checks that block follows every consensus rule that applies to a block on its own: its proof of work,
+// size and summary, and the size, time, key and signature of each of its posts. If parent is not nil, block must also
+// link to it. Rules about timestamps of blocks need the blocks before them, and are left to ValidateChain.
+// Returns nil, or a *ValidationError for the first rule found broken. Neither block is modified.
+func ValidateBlock(parent *Block, block *Block) error {
+	if !block.Header.Verify() {
+		return &ValidationError{Rule: RuleProofOfWork, Height: -1, Post: -1}
+	}
+	if err := block.validate(false); err != nil {
+		err.Height = -1
+		return err
+	}
+	if invalid := VerifyPosts(block.Posts, nil); invalid >= 0 {
+		return &ValidationError{Rule: RuleSignature, Height: -1, Post: invalid}
+	}
+	if parent != nil && !bytes.Equal(block.Header.PrevHash, parent.Header.Hash()) {
+		return &ValidationError{Rule: RuleLinkage, Height: -1, Post: -1}
+	}
+	return nil
+}
+
+// ValidateChain - checks that chain follows every consensus rule: each block is valid on its own, is dated after the
+// blocks before it and not in the future, and links to the block before it, the blockchain starts from its network's
+// genesis block and passes through the network's checkpoints, and no post appears twice. Blocks below options.Pruned
+// are only checked by their headers, so posts of later blocks are not checked against theirs. Signatures are verified
+// last, in parallel, since that takes longest. The identity hash of every block is memoised, as Block.Hash does.
+// A chain that starts above height 0 is only a segment, whose link to the blocks below it is left to the caller. The
+// median time past of its first MedianTimeSpan blocks only covers the blocks in options.Prev and the segment, so
+// unless Prev holds the MedianTimeSpan blocks below Start, their timestamps are checked against fewer blocks than the
+// consensus rule requires. Timestamps are not checked at all if options.Now is zero.
+// Returns nil, or a *ValidationError for the first rule found broken.
+func ValidateChain(chain []Block, options ValidateOptions) error {
+	network := options.Network
+	if network == nil {
+		network = &MainNetwork
+	}
+	// the blocks whose timestamps the median time past of each block covers, ending right before chain
+	timeline, offset := chain, 0
+	if options.Start > 0 && len(options.Prev) > 0 {
+		prev := options.Prev[max(len(options.Prev)-MedianTimeSpan, 0):]
+		timeline = append(append(make([]Block, 0, len(prev)+len(chain)), prev...), chain...)
+		offset = len(prev)
+	}
+	for i := range chain {
+		block := &chain[i]
+		height := options.Start + i
+		if !block.VerifyHeader() {
+			return &ValidationError{Rule: RuleProofOfWork, Height: height, Post: -1}
+		}
+		if height < options.Pruned {
+			if len(block.Posts) > 0 {
+				return &ValidationError{Rule: RulePrunedPosts, Height: height, Post: -1}
+			}
+		} else if err := block.validate(options.Partial); err != nil {
+			err.Height = height
+			return err
+		}
+		if !options.Now.IsZero() && !block.VerifyTime(timeline[:offset+i], options.Now) {
+			if block.Header.Timestamp > options.Now.Add(MaxFutureDrift).UnixNano() {
+				return &ValidationError{Rule: RuleFuture, Height: height, Post: -1}
+			}
+			return &ValidationError{Rule: RuleBlockTime, Height: height, Post: -1}
+		}
+	}
+	// signatures are verified all at once, so that they are spread over all CPU cores
+	posts := make([]Post, 0)
+	blocks := make([]int, 0) // index of the block of each post
+	for i, block := range chain {
+		posts = append(posts, block.Posts...)
+		for range block.Posts {
+			blocks = append(blocks, i)
+		}
+	}
+	if invalid := VerifyPosts(posts, options.Cache); invalid >= 0 {
+		i := blocks[invalid]
+		first := invalid
+		for first > 0 && blocks[first-1] == i {
+			first--
+		}
+		return &ValidationError{Rule: RuleSignature, Height: options.Start + i, Post: invalid - first}
+	}
+	// their hash value must form a chain starting from the genesis block
+	if options.Start == 0 && len(chain) > 0 && !bytes.Equal(chain[0].Header.PrevHash, network.GenesisHash()) {
+		return &ValidationError{Rule: RuleGenesis, Height: 0, Post: -1}
+	}
+	for i := 1; i < len(chain); i++ {
+		if !bytes.Equal(chain[i].Header.PrevHash, chain[i-1].Hash()) {
+			return &ValidationError{Rule: RuleLinkage, Height: options.Start + i, Post: -1}
+		}
+	}
+	if height := network.verifyCheckpoints(chain, options.Start); height >= 0 {
+		return &ValidationError{Rule: RuleCheckpoint, Height: height, Post: -1}
+	}
+	// no duplicated posts
+	seen := make(map[string]bool)
+	for i, block := range chain {
+		for j, post := range block.Posts {
+			key := postKey(&post)
+			if seen[key] {
+				return &ValidationError{Rule: RuleDuplicatePost, Height: options.Start + i, Post: j}
+			}
+			seen[key] = true
+		}
+	}
+	return nil
+}
+
+// validate - checks the rules of a block on its own other than its proof of work and the signatures of its posts.
+// The summary is not checked if the block may hold only some of its posts. The returned error has no height.
+func (b *Block) validate(partial bool) *ValidationError {
+	if len(b.Posts) > MaxBlockPosts || b.Size() > MaxBlockSize {
+		return &ValidationError{Rule: RuleBlockSize, Post: -1}
+	}
+	if !partial && !bytes.Equal(b.Header.Summary, MerkleRoot(b.Posts)) {
+		return &ValidationError{Rule: RuleSummary, Post: -1}
+	}
+	for i, post := range b.Posts {
+		if len(post.Body.Content) > MaxContentSize {
+			return &ValidationError{Rule: RuleContentSize, Post: i}
+		}
+		if !post.VerifyTime(b.Header.Timestamp) {
+			return &ValidationError{Rule: RulePostTime, Post: i}
+		}
+		if post.User == nil || post.User.Validate() != nil {
+			return &ValidationError{Rule: RuleWeakKey, Post: i}
+		}
+	}
+	return nil
+}
+
+// postKey - what two posts of a blockchain must not share: their timestamp and user key.
+func postKey(post *Post) string {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(post.Body.Timestamp))
+	return string(timestamp[:]) + string(PublicKeyToBytes(post.User))
+}
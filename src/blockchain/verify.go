@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// VerifyCache - IDs of posts whose signatures have been verified recently, so that they are not verified again when
+// the same posts arrive in blocks. Post IDs cover the user, body and signatures of posts, so a cached ID vouches for
+// exactly the post it was computed from. The oldest IDs are evicted first once the cache is full.
+type VerifyCache struct {
+	ids    map[string]struct{}
+	order  []string // ring buffer of ids in the order they were added
+	next   int      // position in order of the next ID to add
+	hits   uint64
+	misses uint64
+	lock   sync.Mutex
+}
+
+// NewVerifyCache - creates an empty VerifyCache that holds at most size post IDs.
+func NewVerifyCache(size int) *VerifyCache {
+	return &VerifyCache{ids: make(map[string]struct{}), order: make([]string, size)}
+}
+
+// Verify - verifies the post as Post.Verify does, unless the cache has verified it before. Valid posts are remembered.
+// A nil cache verifies every post.
+func (c *VerifyCache) Verify(post *Post) bool {
+	if c == nil {
+		return post.Verify()
+	}
+	id := string(post.ID())
+	if c.contains(id) {
+		return true
+	}
+	if !post.Verify() {
+		return false
+	}
+	c.add(id)
+	return true
+}
+
+// Add - remembers a post that the caller has verified with Post.Verify, so that callers which may still turn the post
+// down only cache it once they accept it. A nil cache remembers nothing.
+func (c *VerifyCache) Add(post *Post) {
+	if c == nil {
+		return
+	}
+	c.add(string(post.ID()))
+}
+
+// Stats - the number of posts that were found in the cache, and the number that had to be verified.
+func (c *VerifyCache) Stats() (hits uint64, misses uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.hits, c.misses
+}
+
+// contains - checks whether a post ID has been verified recently, and counts the lookup.
+func (c *VerifyCache) contains(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.ids[id]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return ok
+}
+
+// add - remembers a verified post ID, evicting the oldest one if the cache is full.
+func (c *VerifyCache) add(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.ids[id]; ok || len(c.order) == 0 {
+		return
+	}
+	if old := c.order[c.next]; old != "" {
+		delete(c.ids, old)
+	}
+	c.order[c.next] = id
+	c.ids[id] = struct{}{}
+	c.next = (c.next + 1) % len(c.order)
+}
+
+// VerifyPosts - verifies posts as Post.Verify does, spreading them over all CPU cores, and returns the index of the
+// first invalid post, or -1 if every post is valid. Posts that cache has verified before are not verified again, and
+// valid posts are added to it. cache may be nil.
+func VerifyPosts(posts []Post, cache *VerifyCache) int {
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(posts) {
+		workers = len(posts)
+	}
+	if workers <= 1 {
+		for i := range posts {
+			if !cache.Verify(&posts[i]) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	// workers take posts in order, and skip the posts after an invalid one that has been found
+	var next atomic.Int64
+	var invalid atomic.Int64
+	invalid.Store(int64(len(posts)))
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := next.Add(1) - 1
+				if i >= invalid.Load() {
+					return
+				}
+				if cache.Verify(&posts[i]) {
+					continue
+				}
+				for {
+					first := invalid.Load()
+					if i >= first || invalid.CompareAndSwap(first, i) {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if first := invalid.Load(); first < int64(len(posts)) {
+		return int(first)
+	}
+	return -1
+}
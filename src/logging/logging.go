@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"time"
+)
+
+// ShortHash - formats the first 8 bytes of an identity hash in hex, which is enough to tell blocks apart in logs.
+func ShortHash(hash []byte) string {
+	if len(hash) > 8 {
+		hash = hash[:8]
+	}
+	return hex.EncodeToString(hash)
+}
+
+// Middleware - logs every http request handled by a gin router at debug level.
+func Middleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		logger.Debug("handled request",
+			"method", ctx.Request.Method,
+			"path", ctx.Request.URL.Path,
+			"status", ctx.Writer.Status(),
+			"latency", time.Since(start),
+			"client", ctx.ClientIP(),
+		)
+	}
+}
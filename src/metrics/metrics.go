@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentType - Content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric - a named metric that can write its samples in Prometheus text format.
+type metric interface {
+	write(w *bytes.Buffer)
+}
+
+// Registry - A set of metrics that are exposed together.
+type Registry struct {
+	metrics []metric   // in the order of registration
+	lock    sync.Mutex // protects metrics
+}
+
+// NewRegistry - creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register - adds a metric to the registry.
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo - writes all metrics in Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	metrics := append(make([]metric, 0), r.metrics...)
+	r.lock.Unlock()
+	var buffer bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buffer)
+	}
+	return buffer.WriteTo(w)
+}
+
+// writeHeader - writes the HELP and TYPE lines of a metric.
+func writeHeader(w *bytes.Buffer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatFloat - formats a sample value the way Prometheus expects.
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Counter - A monotonically increasing count.
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+// Counter - registers a new Counter.
+func (r *Registry) Counter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	r.register(c)
+	return c
+}
+
+// Inc - adds one to the counter.
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add - adds delta to the counter.
+func (c *Counter) Add(delta uint64) {
+	c.value.Add(delta)
+}
+
+// Value - returns the current count.
+func (c *Counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *Counter) write(w *bytes.Buffer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+}
+
+// CounterVec - A family of counters partitioned by the values of a fixed set of labels.
+type CounterVec struct {
+	name     string
+	help     string
+	labels   []string
+	counters map[string]*Counter // maps the formatted label values to their counter
+	lock     sync.Mutex          // protects counters
+}
+
+// CounterVec - registers a new CounterVec with the given label names.
+func (r *Registry) CounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, counters: make(map[string]*Counter)}
+	r.register(c)
+	return c
+}
+
+// With - returns the counter of the given label values, one for each label name, creating it if needed.
+func (c *CounterVec) With(values ...string) *Counter {
+	pairs := make([]string, len(c.labels))
+	for i, label := range c.labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs[i] = fmt.Sprintf("%s=%q", label, value)
+	}
+	key := strings.Join(pairs, ",")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counter, ok := c.counters[key]
+	if !ok {
+		counter = &Counter{name: c.name, help: c.help}
+		c.counters[key] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w *bytes.Buffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	keys := make([]string, 0, len(c.counters))
+	for key := range c.counters {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s} %d\n", c.name, key, c.counters[key].Value())
+	}
+}
+
+// Gauge - A value that can go up and down.
+type Gauge struct {
+	name  string
+	help  string
+	bits  atomic.Uint64 // math.Float64bits of the value
+	value func() float64
+}
+
+// Gauge - registers a new Gauge that is set explicitly.
+func (r *Registry) Gauge(name string, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	r.register(g)
+	return g
+}
+
+// GaugeFunc - registers a new Gauge whose value is computed by calling value on every scrape.
+func (r *Registry) GaugeFunc(name string, help string, value func() float64) {
+	r.register(&Gauge{name: name, help: help, value: value})
+}
+
+// Set - sets the gauge to value.
+func (g *Gauge) Set(value float64) {
+	g.bits.Store(math.Float64bits(value))
+}
+
+// Value - returns the current value of the gauge.
+func (g *Gauge) Value() float64 {
+	if g.value != nil {
+		return g.value()
+	}
+	return math.Float64frombits(g.bits.Load())
+}
+
+func (g *Gauge) write(w *bytes.Buffer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.Value()))
+}
+
+// Histogram - Counts observations in cumulative buckets.
+type Histogram struct {
+	name   string
+	help   string
+	bounds []float64  // upper bounds of the buckets, in increasing order
+	counts []uint64   // number of observations in each bucket, the last one being +Inf
+	sum    float64    // sum of all observations
+	count  uint64     // number of observations
+	lock   sync.Mutex // protects counts, sum and count
+}
+
+// Histogram - registers a new Histogram with the given upper bounds of buckets, in increasing order.
+func (r *Registry) Histogram(name string, help string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	r.register(h)
+	return h
+}
+
+// Observe - records one observation.
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := sort.SearchFloat64s(h.bounds, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// Count - returns the number of observations.
+func (h *Histogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	cumulative := uint64(0)
+	for i, bound := range append(append(make([]float64, 0), h.bounds...), math.Inf(1)) {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", h.name, formatFloat(h.sum), h.name, h.count)
+}
@@ -0,0 +1,192 @@
+package miner
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AddressExpiry - An address is forgotten once nothing has shown for AddressExpiry that a miner listens on it.
+const AddressExpiry = 10 * time.Minute
+
+// MaxExchangeAddresses - A /peers request or response carries at most MaxExchangeAddresses addresses.
+const MaxExchangeAddresses = 100
+
+// MaxAddresses - An address book holds at most MaxAddresses addresses. A live address evicts the one that was seen
+// longest ago once the book is full, while gossiped addresses are dropped.
+const MaxAddresses = 1000
+
+// addressBook - ports of miners known to this miner, kept so that it can keep gossiping when the tracker is down.
+type addressBook struct {
+	path  string            // file in which the book persists across restarts, empty to keep it in memory only
+	self  int               // this miner's port, which is never added
+	seen  map[int]time.Time // when each address was last shown to be live
+	dirty bool              // whether seen has changed since the last save
+	lock  sync.Mutex        // protects seen and dirty
+}
+
+// AddressJson - an entry of the address book file.
+type AddressJson struct {
+	Port     int   `json:"port"`
+	LastSeen int64 `json:"last-seen"` // unix time in milliseconds when the address was last shown to be live
+}
+
+// AddressBookJson - format of the address book file.
+type AddressBookJson struct {
+	Addresses []AddressJson `json:"addresses"`
+}
+
+// newAddressBook - creates an address book, loading it from path if the file exists. Loaded addresses are given a
+// fresh chance, since the miner may have been down for longer than AddressExpiry.
+func newAddressBook(path string, self int) (*addressBook, error) {
+	book := &addressBook{path: path, self: self, seen: make(map[int]time.Time)}
+	if path == "" {
+		return book, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return book, nil
+	}
+	if err != nil {
+		return book, err
+	}
+	var file AddressBookJson
+	if err := json.Unmarshal(data, &file); err != nil {
+		return book, err
+	}
+	// the most recently seen addresses are kept if the file holds too many
+	sort.Slice(file.Addresses, func(i, j int) bool {
+		return file.Addresses[i].LastSeen > file.Addresses[j].LastSeen
+	})
+	now := time.Now()
+	for _, address := range file.Addresses {
+		if address.Port > 0 && address.Port != self && len(book.seen) < MaxAddresses {
+			book.seen[address.Port] = now
+		}
+	}
+	return book, nil
+}
+
+// markSeen - records that miners listen on ports now, adding ports that are not in the book yet.
+func (b *addressBook) markSeen(ports ...int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	for _, port := range ports {
+		if port <= 0 || port == b.self {
+			continue
+		}
+		if _, ok := b.seen[port]; !ok && !b.makeRoom() {
+			b.evictOldest()
+		}
+		b.seen[port] = now
+		b.dirty = true
+	}
+}
+
+// learn - adds ports gossiped by a peer. Gossip is not evidence that a miner is live, so known ports are not
+// refreshed, and new ports expire unless they are shown to be live within AddressExpiry.
+func (b *addressBook) learn(ports []int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	for i, port := range ports {
+		if i >= MaxExchangeAddresses {
+			break
+		}
+		if _, ok := b.seen[port]; !ok && port > 0 && port != b.self && b.makeRoom() {
+			b.seen[port] = now
+			b.dirty = true
+		}
+	}
+}
+
+// makeRoom - checks whether another address fits in the book, forgetting expired addresses first if it is full.
+// Must be called with lock held.
+func (b *addressBook) makeRoom() bool {
+	if len(b.seen) < MaxAddresses {
+		return true
+	}
+	b.prune()
+	return len(b.seen) < MaxAddresses
+}
+
+// evictOldest - forgets the address that was seen longest ago. Must be called with lock held.
+func (b *addressBook) evictOldest() {
+	oldest, found := 0, false
+	for port, seen := range b.seen {
+		if !found || seen.Before(b.seen[oldest]) {
+			oldest, found = port, true
+		}
+	}
+	if found {
+		delete(b.seen, oldest)
+		b.dirty = true
+	}
+}
+
+// prune - forgets the addresses that have expired. Must be called with lock held.
+func (b *addressBook) prune() {
+	for port, seen := range b.seen {
+		if time.Since(seen) > AddressExpiry {
+			delete(b.seen, port)
+			b.dirty = true
+		}
+	}
+}
+
+// list - returns the known ports in increasing order.
+func (b *addressBook) list() []int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.prune()
+	ports := make([]int, 0, len(b.seen))
+	for port := range b.seen {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// save - writes the book to its file if it has changed. The file is replaced atomically, so that a crash never leaves
+// a truncated book behind.
+func (b *addressBook) save() error {
+	b.lock.Lock()
+	b.prune()
+	if b.path == "" || !b.dirty {
+		b.lock.Unlock()
+		return nil
+	}
+	file := AddressBookJson{Addresses: make([]AddressJson, 0, len(b.seen))}
+	for port, seen := range b.seen {
+		file.Addresses = append(file.Addresses, AddressJson{Port: port, LastSeen: seen.UnixMilli()})
+	}
+	b.dirty = false
+	b.lock.Unlock()
+	sort.Slice(file.Addresses, func(i, j int) bool {
+		return file.Addresses[i].Port < file.Addresses[j].Port
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.path)
+}
@@ -0,0 +1,148 @@
+package miner
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// NodeIDHeader - Header carrying the hex-encoded public node key of the sender of a peer request.
+const NodeIDHeader = "X-Node-ID"
+
+// TimestampHeader - Header carrying the unix time in milliseconds at which a peer request is signed.
+const TimestampHeader = "X-Node-Timestamp"
+
+// SignatureHeader - Header carrying the base64-encoded signature of a peer request.
+const SignatureHeader = "X-Node-Signature"
+
+// NetworkHeader - Header carrying the ID of the network that the sender of a peer request belongs to.
+const NetworkHeader = "X-Network-ID"
+
+// MaxClockSkew - A signed peer request is refused if its timestamp is further than MaxClockSkew from the receiver's
+// clock, which limits how long the receiver must remember its signature to refuse replays of it.
+const MaxClockSkew = time.Minute
+
+// ReplayCacheSize - Number of signatures of peer requests remembered, so that a captured request is refused if it is
+// sent again. A signature evicted from a full cache could be replayed until its request becomes stale, so the cache
+// holds more requests than a miner's peers send within MaxClockSkew.
+const ReplayCacheSize = 100000
+
+// errUnsigned - the peer request carries no node ID or signature.
+var errUnsigned = errors.New("peer message is unsigned")
+
+// errBadSignature - the signature of the peer request does not match its node ID.
+var errBadSignature = errors.New("peer message has an invalid signature")
+
+// errStale - the timestamp of the peer request is too far from the receiver's clock.
+var errStale = errors.New("peer message is stale")
+
+// errReplayed - the peer request has been received before.
+var errReplayed = errors.New("peer message is replayed")
+
+// NodeID - the identity of a miner, derived from its public node key.
+func NodeID(key ed25519.PublicKey) string {
+	return hex.EncodeToString(key)
+}
+
+// signedMessage - the bytes covered by the signature of a peer request to host on network whose body has the sha256
+// digest. The host names the receiver, so that a request cannot be replayed to another miner either.
+func signedMessage(method string, host string, path string, port string, network string, timestamp string, digest []byte) []byte {
+	return []byte(fmt.Sprintf("%s %s%s\n%s\n%s\n%s\n%x", method, host, path, port, network, timestamp, digest))
+}
+
+// SignRequest - signs a peer request on behalf of the miner listening on port.
+// Parameters:
+//
+//	req (*http.Request): The /sync or /broadcast request to sign, whose Host is the receiver's; its headers are set.
+//	key (ed25519.PrivateKey): The node key of the sender.
+//	port (int): The http port of the sender, declared in PeerHeader.
+//	network (string): The ID of the sender's network, declared in NetworkHeader.
+//	body ([]byte): The body of req.
+func SignRequest(req *http.Request, key ed25519.PrivateKey, port int, network string, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	digest := sha256.Sum256(body)
+	message := signedMessage(req.Method, req.Host, req.URL.Path, strconv.Itoa(port), network, timestamp, digest[:])
+	req.Header.Set(PeerHeader, strconv.Itoa(port))
+	req.Header.Set(NetworkHeader, network)
+	req.Header.Set(NodeIDHeader, NodeID(key.Public().(ed25519.PublicKey)))
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, base64.StdEncoding.EncodeToString(ed25519.Sign(key, message)))
+}
+
+// nodeKeyOf - decodes the node key declared by a peer request, without checking the signature.
+func nodeKeyOf(req *http.Request) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(req.Header.Get(NodeIDHeader))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errUnsigned
+	}
+	return key, nil
+}
+
+// verifyRequest - checks that a peer request whose body has the sha256 digest is signed by key recently, and that its
+// signature is not in replays, to which it is added.
+func verifyRequest(req *http.Request, key ed25519.PublicKey, digest []byte, replays *seenCache) error {
+	signature, err := base64.StdEncoding.DecodeString(req.Header.Get(SignatureHeader))
+	if err != nil || len(signature) == 0 {
+		return errUnsigned
+	}
+	timestamp := req.Header.Get(TimestampHeader)
+	millis, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errUnsigned
+	}
+	if skew := time.Since(time.UnixMilli(millis)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return errStale
+	}
+	message := signedMessage(req.Method, req.Host, req.URL.Path, req.Header.Get(PeerHeader), req.Header.Get(NetworkHeader),
+		timestamp, digest)
+	if !ed25519.Verify(key, message, signature) {
+		return errBadSignature
+	}
+	// ed25519 signatures are deterministic and are not malleable, so a replayed request has the same signature
+	if !replays.add(string(signature)) {
+		return errReplayed
+	}
+	return nil
+}
+
+// adminGuard - middleware of the /admin APIs, which only operators may use. With an admin token, requests must carry it
+// as a bearer token; without one, only clients on the miner's own host are served.
+func (m *Miner) adminGuard(ctx *gin.Context) {
+	if m.adminToken == "" {
+		host, _, err := net.SplitHostPort(ctx.Request.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "admin APIs are only served locally"})
+			return
+		}
+	} else if subtle.ConstantTimeCompare([]byte(ctx.GetHeader("Authorization")), []byte("Bearer "+m.adminToken)) != 1 {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{"error": "admin token is missing or wrong"})
+		return
+	}
+	ctx.Next()
+}
+
+// postToPeer - sends a signed json request to a peer's API.
+func (m *Miner) postToPeer(peer int, path string, data []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, m.tls.URL(peer, path), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	SignRequest(req, m.nodeKey, m.port, m.networkID, data)
+	resp, err := m.client.Do(req)
+	if err == nil {
+		// any response shows that the peer is live
+		m.book.markSeen(peer)
+	}
+	return resp, err
+}
@@ -0,0 +1,134 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"time"
+)
+
+// SubscriberBuffer - Number of events buffered for each /events subscriber. A subscriber that falls further behind
+// is disconnected, and is expected to reconnect and replay from the last height it has seen.
+const SubscriberBuffer = 64
+
+// EventBlock - A block was appended to the miner's blockchain.
+const EventBlock = "block"
+
+// EventReorg - The miner switched to another blockchain, discarding all blocks from Height onwards.
+const EventReorg = "reorg"
+
+// EventPost - A post was admitted to the miner's pool.
+const EventPost = "post"
+
+// EventJson - an event sent on /events.
+type EventJson struct {
+	Type   string                  `json:"type"`            // EventBlock, EventReorg or EventPost
+	Height int                     `json:"height"`          // height of Block, or the first discarded height of a reorg
+	Block  *blockchain.BlockBase64 `json:"block,omitempty"` // the new block of EventBlock, without posts if pruned
+	Post   *blockchain.PostBase64  `json:"post,omitempty"`  // the admitted post of EventPost
+}
+
+// EventsQuery - query parameters of /events.
+type EventsQuery struct {
+	From int `form:"from"` // replay blocks from this height before streaming new events
+}
+
+// subscribe - registers a new subscriber of events.
+// m.lock must be held, so that no event is published between reading the blockchain and subscribing.
+func (m *Miner) subscribe() chan EventJson {
+	ch := make(chan EventJson, SubscriberBuffer)
+	m.subLock.Lock()
+	defer m.subLock.Unlock()
+	m.subscribers[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe - removes a subscriber, closing its channel if it has not been closed yet.
+func (m *Miner) unsubscribe(ch chan EventJson) {
+	m.subLock.Lock()
+	defer m.subLock.Unlock()
+	if _, ok := m.subscribers[ch]; ok {
+		delete(m.subscribers, ch)
+		close(ch)
+	}
+}
+
+// unsubscribeAll - closes all subscribers, so that their /events streams end.
+func (m *Miner) unsubscribeAll() {
+	m.subLock.Lock()
+	defer m.subLock.Unlock()
+	for ch := range m.subscribers {
+		delete(m.subscribers, ch)
+		close(ch)
+	}
+}
+
+// publish - sends an event to all subscribers without blocking. Subscribers that are too slow are dropped.
+// m.lock must be held for writing, so that events are published in the same order as the blockchain changes.
+func (m *Miner) publish(event EventJson) {
+	m.subLock.Lock()
+	defer m.subLock.Unlock()
+	for ch := range m.subscribers {
+		select {
+		case ch <- event:
+		default:
+			delete(m.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// publishBlocks - publishes EventBlock for blocks from height start to the tip of the blockchain.
+// m.lock must be held for writing.
+func (m *Miner) publishBlocks(start int) {
+	for i := start; i < len(m.blockChain); i++ {
+		encoded := m.blockChain[i].EncodeBase64()
+		m.publish(EventJson{Type: EventBlock, Height: i, Block: &encoded})
+	}
+}
+
+// publishPost - publishes EventPost for a post admitted to the pool.
+// m.lock must be held for writing.
+func (m *Miner) publishPost(post blockchain.Post) {
+	encoded := post.EncodeBase64()
+	m.publish(EventJson{Type: EventPost, Height: len(m.blockChain), Post: &encoded})
+}
+
+// eventsHandler - handles /events request from a user
+// streams server-sent events, first replaying blocks from query.From and then following new events
+func (m *Miner) eventsHandler(ctx *gin.Context, query EventsQuery) {
+	if query.From < 0 {
+		ctx.JSON(http.StatusBadRequest, map[string]string{"error": "query has negative heights"})
+		return
+	}
+	// gather blocks to replay and subscribe atomically
+	m.lock.RLock()
+	replay := make([]EventJson, 0)
+	for i := query.From; i < len(m.blockChain); i++ {
+		encoded := m.blockChain[i].EncodeBase64()
+		replay = append(replay, EventJson{Type: EventBlock, Height: i, Block: &encoded})
+	}
+	ch := m.subscribe()
+	m.lock.RUnlock()
+	defer m.unsubscribe(ch)
+	// the stream lasts for as long as the user follows it
+	_ = http.NewResponseController(ctx.Writer).SetWriteDeadline(time.Time{})
+
+	for _, event := range replay {
+		ctx.SSEvent(event.Type, event)
+	}
+	ctx.Writer.Flush()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return false
+			}
+			ctx.SSEvent(event.Type, event)
+			return true
+		case <-ctx.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -2,28 +2,118 @@ package miner
 
 import (
 	"blockchain/blockchain"
+	"blockchain/logging"
+	"blockchain/tracker"
 	"bytes"
+	"encoding/base64"
+	"errors"
 	"github.com/emirpasic/gods/sets/treeset"
-	"log"
+	"io"
 	"net/http"
+	"time"
 )
 
 // readHandler - handles /read request from a user
-// encodes and returns the miner's complete blockchain
-func (m *Miner) readHandler() (int, any) {
+// encodes and returns the requested part of the miner's blockchain
+func (m *Miner) readHandler(query ReadQuery) (int, any) {
+	if query.From < 0 || query.To < 0 || query.Limit < 0 || query.Cursor < 0 {
+		return http.StatusBadRequest, map[string]string{"error": "query has negative heights"}
+	}
+	var author []byte
+	if query.Author != "" {
+		var err error
+		author, err = base64.StdEncoding.DecodeString(query.Author)
+		if err != nil {
+			return http.StatusBadRequest, map[string]string{"error": "author has invalid base64 string"}
+		}
+	}
+	if query.Limit > MaxReadLimit {
+		query.Limit = MaxReadLimit
+	}
+
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 
-	resp := BlockChainJson{}
-	for _, block := range m.blockChain {
-		resp.Blockchain = append(resp.Blockchain, block.EncodeBase64())
+	resp := ReadJson{Height: len(m.blockChain), Pruned: m.pruned, Blockchain: make([]blockchain.BlockBase64, 0)}
+	start := max(query.From, query.Cursor)
+	end := len(m.blockChain)
+	if query.To > 0 {
+		end = min(end, query.To)
+	}
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+		resp.Next = end
+	}
+	resp.Start = start
+	for i := start; i < end; i++ {
+		block := m.blockChain[i]
+		encoded := block.EncodeBase64()
+		if query.Headers {
+			encoded.Posts = nil
+		} else if author != nil || query.Since != 0 || query.Until != 0 {
+			encoded.Posts = nil
+			for _, post := range block.Posts {
+				if author != nil && !bytes.Equal(author, blockchain.PublicKeyToBytes(post.User)) {
+					continue
+				}
+				if post.Body.Timestamp < query.Since || (query.Until != 0 && post.Body.Timestamp >= query.Until) {
+					continue
+				}
+				encoded.Posts = append(encoded.Posts, post.EncodeBase64())
+			}
+		}
+		resp.Blockchain = append(resp.Blockchain, encoded)
 	}
 	return http.StatusOK, resp
 }
 
+// proofHandler - handles /proof request from a light client
+// returns the post of the queried user and timestamp, the height of its block, and the Merkle proof that the summary
+// of the block covers it, so that the client only needs the block's header to verify the post
+func (m *Miner) proofHandler(query ProofQuery) (int, any) {
+	user, err := base64.StdEncoding.DecodeString(query.User)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"error": "user has invalid base64 string"}
+	}
+	publicKey, err := blockchain.PublicKeyFromBytes(user)
+	if err != nil {
+		return http.StatusBadRequest, map[string]string{"error": "user has invalid key"}
+	}
+	stub := blockchain.Post{User: publicKey, Body: blockchain.PostBody{Timestamp: query.Timestamp}}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if !m.posts.Contains(stub) {
+		return http.StatusNotFound, map[string]string{"error": "post is not on the blockchain"}
+	}
+	// recent posts are looked up most often
+	for height := len(m.blockChain) - 1; height >= m.pruned; height-- {
+		block := &m.blockChain[height]
+		for i, post := range block.Posts {
+			if m.cmp(post, stub) != 0 {
+				continue
+			}
+			proof, _ := block.Prove(i)
+			return http.StatusOK, ProofJson{Height: height, Post: post.EncodeBase64(), Proof: proof.EncodeBase64()}
+		}
+	}
+	return http.StatusNotFound, map[string]string{"error": "post is in a pruned block"}
+}
+
 // writeHandler - handles /write request from a user
 // decodes, verifies and adds a user's post to miner's pool
 func (m *Miner) writeHandler(post blockchain.Post) (int, any) {
+	if len(post.Body.Content) > blockchain.MaxContentSize {
+		return http.StatusBadRequest, map[string]string{"error": "post content is too large"}
+	}
+	if post.User == nil || post.User.Validate() != nil {
+		return http.StatusBadRequest, map[string]string{"error": "user key is weak"}
+	}
+	// the post must be dated so that a block mined now may include it; this is checked first, since it is cheap
+	if !post.VerifyTime(time.Now().UnixNano()) {
+		return http.StatusBadRequest, map[string]string{"error": "post timestamp is out of range"}
+	}
+	// the signature is cached only once the post is accepted, so that rejected posts do not evict useful entries
 	if !post.Verify() {
 		return http.StatusBadRequest, map[string]string{"error": "invalid post"}
 	}
@@ -39,71 +129,283 @@ func (m *Miner) writeHandler(post blockchain.Post) (int, any) {
 		return http.StatusBadRequest, map[string]string{"error": "duplicated post in the post"}
 	}
 	m.pool.Add(post)
-	log.Printf("%d: Received post \"%s\" from user", m.port, post.Body.Content)
+	m.verified.Add(&post)
+	m.seen.add(postID(post))
+	m.publishPost(post)
+	m.logger.Info("received post from user", "content", post.Body.Content)
 	return http.StatusOK, nil
 }
 
 // syncHandler - handles /sync request from a peer miner
-// unions this miner's post pool and the posts sent to the API
-func (m *Miner) syncHandler(posts []blockchain.Post) (int, any) {
+// unions this miner's post pool and the posts sent to the API, which the peer listening on sender is known to have,
+// unless sender is 0 because the port is not bound to the peer's node ID
+func (m *Miner) syncHandler(peer string, sender int, posts []blockchain.Post) (int, any) {
+	// all posts must be valid; they are verified before locking, since that takes longest
+	if blockchain.VerifyPosts(posts, m.verified) >= 0 {
+		m.penalize(peer, "invalid-post")
+		return http.StatusBadRequest, map[string]string{"error": "posts are invalid"}
+	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	// all posts must be valid
-	for _, post := range posts {
-		if !post.Verify() {
-			return http.StatusBadRequest, map[string]string{"error": "posts are invalid"}
-		}
-	}
 	// add all posts that are not duplicated
+	now := time.Now().UnixNano()
 	for _, post := range posts {
+		id := postID(post)
+		m.seen.add(id)
+		// posts that have become too old to be mined are dropped, without blaming the peer
+		if !post.VerifyTime(now) {
+			m.markKnown(sender, id)
+			continue
+		}
 		// the new post must not be in the blockchain or pool already
 		if m.posts.Contains(post) || m.pool.Contains(post) {
+			m.markKnown(sender, id)
 			continue
 		}
 		// accept the post
 		m.pool.Add(post)
-		log.Printf("%d: Synced post \"%s\" to pool", m.port, post.Body.Content)
+		m.known[id] = make(map[int]bool)
+		m.markKnown(sender, id)
+		m.publishPost(post)
+		m.logger.Debug("synced post to pool", "content", post.Body.Content)
 	}
 	return http.StatusOK, nil
 }
 
-// broadcastHandler - handles /broadcast request from a peer miner
+// peersHandler - handles /peers request from a peer miner
+// returns the addresses known to this miner other than the peer's own, and adds the addresses known to the peer to the
+// address book
+func (m *Miner) peersHandler(sender int, ports []int) (int, any) {
+	known := make([]int, 0)
+	for _, port := range m.book.list() {
+		if port != sender && len(known) < MaxExchangeAddresses {
+			known = append(known, port)
+		}
+	}
+	m.book.learn(ports)
+	return http.StatusOK, tracker.PortsJson{Ports: known}
+}
+
+// broadcastHandler - handles /broadcast request from a peer miner, which carries the latest blocks of its blockchain
+// from height start on. The blocks of the peer's blockchain that link them to this miner's blockchain are read from
+// the peer listening on sender, from the finality depth below the shorter tip; sender is 0 unless the peer's port is
+// bound to its node ID, in which case a broadcast that does not link directly is ignored. A broadcast that starts more
+// than MaxBroadcastGap blocks above this miner's blockchain is refused, and so is one whose earlier blocks are invalid.
 // if the incoming blockchain is valid and longer than this miner's blockchain, switch to the new blockchain
-func (m *Miner) broadcastHandler(newChain []blockchain.Block) (int, any) {
+func (m *Miner) broadcastHandler(peer string, sender int, start int, newBlocks []blockchain.Block) (int, any) {
+	m.lock.RLock()
+	depth := len(m.blockChain)
+	linked := start == 0 || start <= depth && len(newBlocks) > 0 &&
+		bytes.Equal(newBlocks[0].Header.PrevHash, m.blockChain[start-1].Hash())
+	m.lock.RUnlock()
+	if start+len(newBlocks) <= depth || len(newBlocks) == 0 {
+		// shorter or equal than mine, just ignore it
+		return m.ignoreBroadcast("not-longer")
+	}
+	if start-depth > MaxBroadcastGap {
+		// the blocks in between would have to be read and held before any of them could be checked against this
+		// miner's blockchain
+		return m.rejectBroadcast(peer, "gap", start)
+	}
+
+	from, blocks := start, newBlocks
+	if !linked {
+		// the blocks from a height the miner never discards up to start are read from the peer, which is not trusted
+		// for them any more than for the broadcast: each page is validated as it is read, and the whole chain before
+		// it is adopted
+		from = max(min(depth, start)-m.finality, 0)
+		earlier, err := m.fetchBlocks(sender, from, start)
+		var invalid *blockchain.ValidationError
+		if errors.As(err, &invalid) {
+			return m.rejectBroadcast(peer, string(invalid.Rule), invalid.Height)
+		}
+		if err != nil {
+			m.logger.Info("could not read the blocks of a broadcast", "peer", peer, "from", from, "to", start, "error", err)
+			return m.ignoreBroadcast("unavailable")
+		}
+		if len(earlier) > 0 && !bytes.Equal(newBlocks[0].Header.PrevHash, earlier[len(earlier)-1].Hash()) {
+			// the peer's blockchain changed between the broadcast and the read
+			return m.ignoreBroadcast("unavailable")
+		}
+		blocks = append(earlier, newBlocks...)
+	}
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	depth = len(m.blockChain)
+	if from > depth {
+		return m.ignoreBroadcast("unavailable")
+	}
+	reason, index := "", from
+	if from > 0 && !bytes.Equal(blocks[0].Header.PrevHash, m.blockChain[from-1].Hash()) {
+		// the blockchains fork below from, which is deeper than the finality depth unless this miner's blockchain
+		// changed while the blocks were read
+		reason = "unavailable"
+		if !linked {
+			reason = "finality"
+		}
+	}
+	if reason == "" {
+		reason, index = m.adopt(append(m.blockChain[:from:from], blocks...))
+	}
+	switch reason {
+	case "":
+		m.logger.Info("accepted a broadcast",
+			"height", len(m.blockChain),
+			"hash", logging.ShortHash(m.blockChain[len(m.blockChain)-1].Hash()),
+			"fork", index,
+		)
+		return http.StatusOK, BroadcastResultJson{Result: BroadcastAccepted, Index: -1}
+	case "not-longer", "unavailable":
+		return m.ignoreBroadcast(reason)
+	case "finality":
+		// the chain may well be valid, for a peer returning from a partition, so the refusal is no fault of the peer
+		m.metrics.broadcastsIgnored.With(reason).Inc()
+		m.logger.Error("refused a reorg beyond the finality depth",
+			"alert", true,
+			"peer", peer,
+			"fork", index,
+			"depth", depth-index,
+		)
+		return http.StatusOK, BroadcastResultJson{Result: BroadcastIgnored, Reason: reason, Index: index}
+	}
+	return m.rejectBroadcast(peer, reason, index)
+}
 
+// importHandler - handles /admin/import request, which carries a blockchain in the chain export format
+// the blockchain is adopted as a broadcast one would be, which seeds a new miner, but is never held against anyone
+func (m *Miner) importHandler(r io.Reader) (int, any) {
+	chain, err := blockchain.ImportChain(r, blockchain.ValidateOptions{
+		Network: &m.network,
+		Now:     time.Now(),
+		Cache:   m.verified,
+	})
+	if err != nil {
+		result := BroadcastResultJson{Result: BroadcastInvalid, Reason: "format", Index: -1}
+		var invalid *blockchain.ValidationError
+		switch {
+		case errors.As(err, &invalid):
+			result.Reason, result.Index = string(invalid.Rule), invalid.Height
+		case errors.Is(err, blockchain.ErrWeakKey):
+			result.Reason = "weak-key"
+		case errors.Is(err, blockchain.ErrExportVersion):
+			result.Reason = "version"
+		case errors.Is(err, blockchain.ErrExportNetwork):
+			result.Reason = "network"
+		case errors.Is(err, blockchain.ErrExportChecksum):
+			result.Reason = "checksum"
+		}
+		m.logger.Warn("refused to import a blockchain", "reason", result.Reason, "index", result.Index, "error", err)
+		return http.StatusBadRequest, result
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	reason, index := m.adopt(chain)
+	switch reason {
+	case "":
+		m.logger.Info("imported a blockchain",
+			"height", len(m.blockChain),
+			"hash", logging.ShortHash(m.blockChain[len(m.blockChain)-1].Hash()),
+			"fork", index,
+		)
+		return http.StatusOK, BroadcastResultJson{Result: BroadcastAccepted, Index: -1}
+	case "not-longer":
+		return http.StatusOK, BroadcastResultJson{Result: BroadcastIgnored, Reason: reason, Index: -1}
+	}
+	m.logger.Warn("refused to import a blockchain", "reason", reason, "index", index)
+	return http.StatusBadRequest, BroadcastResultJson{Result: BroadcastInvalid, Reason: reason, Index: index}
+}
+
+// exportHandler - handles /admin/export request
+// returns a copy of the miner's blockchain to write in the chain export format, which needs the posts of every block
+func (m *Miner) exportHandler() (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.pruned > 0 {
+		return http.StatusConflict, map[string]string{"error": "posts of old blocks are pruned"}
+	}
+	// blocks are copied, since pruning replaces them once the lock is released
+	return http.StatusOK, append(make([]blockchain.Block, 0, len(m.blockChain)), m.blockChain...)
+}
+
+// adopt - switches to newChain if it follows every consensus rule, is longer than the miner's blockchain, and does not
+// discard blocks deeper than the finality depth. The miner keeps its own blocks below the height at which newChain
+// forks from them, which may have been pruned, and needs the posts of every block of newChain after them.
+// Returns an empty reason and the fork height if newChain is adopted, or else the reason it is not and the index of the
+// offending block. The caller must hold the write lock.
+func (m *Miner) adopt(newChain []blockchain.Block) (string, int) {
 	if len(newChain) <= len(m.blockChain) {
-		// shorter or equal than mine, just ignore it
-		return http.StatusOK, nil
+		return "not-longer", -1
 	}
-	// each block must be valid
-	for _, block := range newChain {
-		if !block.Verify() {
-			return http.StatusOK, nil
+	fork := 0
+	for ; fork < len(m.blockChain); fork++ {
+		if !bytes.Equal(m.blockChain[fork].Hash(), newChain[fork].Hash()) {
+			break
+		}
+	}
+	// blocks deeper than the finality depth are never discarded, and neither are pruned blocks, whose posts could not
+	// return to the pool; this is checked first, since such a chain is refused without penalty whether it is valid or not
+	if len(m.blockChain)-fork > m.finality || fork < m.pruned {
+		return "finality", fork
+	}
+	for i := fork; i < len(newChain); i++ {
+		if newChain[i].IsPruned() {
+			return "pruned", i
 		}
 	}
-	// their hash value must form a chain
-	if !bytes.Equal(newChain[0].Header.PrevHash, make([]byte, 32)) {
-		return http.StatusOK, nil
+	chain := append(m.blockChain[:fork:fork], newChain[fork:]...)
+	// the blocks below fork are the miner's own, which were validated when they were added, so only the new blocks
+	// must follow every consensus rule; this memoises the hash of each new block, which later readers of the chain
+	// reuse, and posts that were written to or synced with this miner are found in the verification cache
+	if fork > 0 && !bytes.Equal(chain[fork].Header.PrevHash, chain[fork-1].Hash()) {
+		return string(blockchain.RuleLinkage), fork
+	}
+	err := blockchain.ValidateChain(chain[fork:], blockchain.ValidateOptions{
+		Network: &m.network,
+		Start:   fork,
+		Prev:    chain[max(fork-blockchain.MedianTimeSpan, 0):fork],
+		Now:     time.Now(),
+		Cache:   m.verified,
+	})
+	var invalid *blockchain.ValidationError
+	if errors.As(err, &invalid) {
+		return string(invalid.Rule), invalid.Height
 	}
-	for i := 1; i < len(newChain); i++ {
-		if !bytes.Equal(newChain[i].Header.PrevHash, blockchain.Hash(newChain[i-1].Header)) {
-			return http.StatusOK, nil
+	// posts of the new blocks must not repeat those of the kept blocks, which are the miner's posts but for those of
+	// the discarded blocks; these are few, since no more blocks than the finality depth are discarded
+	discarded := treeset.NewWith(m.cmp)
+	for _, block := range m.blockChain[fork:] {
+		for _, post := range block.Posts {
+			discarded.Add(post)
 		}
 	}
-	// no duplicated posts
-	posts := treeset.NewWith(m.cmp)
-	for _, block := range newChain {
+	for i, block := range chain[fork:] {
 		for _, post := range block.Posts {
-			if posts.Contains(post) {
-				return http.StatusOK, nil
+			if m.posts.Contains(post) && !discarded.Contains(post) {
+				return string(blockchain.RuleDuplicatePost), fork + i
 			}
-			posts.Add(post)
 		}
 	}
-	// all checks passed, compute the new pool
+	// the chain is adopted, so the miner's posts are updated in place
+	posts := m.posts
+	posts.Remove(discarded.Values()...)
+	for _, block := range chain[fork:] {
+		for _, post := range block.Posts {
+			posts.Add(post.Stub())
+			m.seen.add(postID(post))
+		}
+	}
+	m.switchTo(chain, fork, posts)
+	return "", fork
+}
+
+// switchTo - replaces the miner's blockchain with chain, which shares the miner's blocks below fork, and the stubs of
+// whose posts are posts. Posts of discarded blocks return to the pool, subscribers are told of the new blocks, and old
+// blocks are pruned. The caller must hold the write lock.
+func (m *Miner) switchTo(chain []blockchain.Block, fork int, posts *treeset.Set) {
+	// compute the new pool, to which posts of the discarded blocks return
 	pool := treeset.NewWith(m.cmp)
 	iter := m.pool.Iterator()
 	for iter.Next() {
@@ -112,25 +414,37 @@ func (m *Miner) broadcastHandler(newChain []blockchain.Block) (int, any) {
 			pool.Add(post)
 		}
 	}
-	// any blocks that are discarded will return to the pool
-	i := 0
-	for ; i < len(m.blockChain); i++ {
-		if !bytes.Equal(blockchain.Hash(m.blockChain[i].Header), blockchain.Hash(newChain[i].Header)) {
-			break
-		}
-	}
-	// blocks from i to the end are discarded
-	for ; i < len(m.blockChain); i++ {
-		for _, post := range m.blockChain[i].Posts {
+	for _, block := range m.blockChain[fork:] {
+		for _, post := range block.Posts {
 			if !posts.Contains(post) {
 				pool.Add(post)
 			}
 		}
 	}
 	// update everything
-	m.blockChain = newChain
+	if fork < len(m.blockChain) {
+		m.publish(EventJson{Type: EventReorg, Height: fork})
+		m.metrics.reorgDepth.Observe(float64(len(m.blockChain) - fork))
+	}
+	m.metrics.blocksAccepted.Add(uint64(len(chain) - fork))
+	m.blockChain = chain
 	m.posts = posts
 	m.pool = pool
-	log.Printf("%d: Accepted a broadcast, chain length %d\n", m.port, len(m.blockChain))
-	return http.StatusOK, nil
+	m.publishBlocks(fork)
+	m.prune()
+}
+
+// ignoreBroadcast - ignores a broadcast without holding it against the peer, for a reason that is no fault of the peer
+func (m *Miner) ignoreBroadcast(reason string) (int, any) {
+	m.metrics.broadcastsIgnored.With(reason).Inc()
+	return http.StatusOK, BroadcastResultJson{Result: BroadcastIgnored, Reason: reason, Index: -1}
+}
+
+// rejectBroadcast - records a broadcast that breaks the rule named by reason at block index, penalizes its sender,
+// and returns the response to the sender.
+func (m *Miner) rejectBroadcast(peer string, reason string, index int) (int, any) {
+	m.metrics.blocksRejected.With(reason).Inc()
+	m.penalize(peer, reason)
+	m.logger.Info("rejected an invalid broadcast", "peer", peer, "reason", reason, "index", index)
+	return http.StatusBadRequest, BroadcastResultJson{Result: BroadcastInvalid, Reason: reason, Index: index}
 }
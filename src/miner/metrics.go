@@ -0,0 +1,63 @@
+package miner
+
+import "blockchain/metrics"
+
+// minerMetrics - metrics of a Miner exposed on /metrics.
+type minerMetrics struct {
+	registry          *metrics.Registry
+	hashes            *metrics.Counter    // nonces tried while mining
+	blocksMined       *metrics.Counter    // blocks mined by this miner
+	broadcastsSent    *metrics.Counter    // broadcast requests sent to peers
+	broadcastsFailed  *metrics.Counter    // broadcast requests that failed or were not accepted
+	broadcastResults  *metrics.CounterVec // results reported by peers for broadcasts, by result and reason
+	blocksAccepted    *metrics.Counter    // blocks adopted from peers' broadcasts
+	blocksRejected    *metrics.CounterVec // broadcasts from peers that were rejected as invalid, by reason
+	broadcastsIgnored *metrics.CounterVec // broadcasts from peers that were ignored through no fault of theirs, by reason
+	reorgDepth        *metrics.Histogram  // number of blocks discarded when switching to a peer's blockchain
+	syncLatency       *metrics.Histogram  // seconds taken by each /sync request to a peer
+	postsAnnounced    *metrics.Counter    // post IDs announced to peers with /inv
+	postsRelayed      *metrics.Counter    // posts sent to peers that asked for them
+	penalties         *metrics.CounterVec // misbehaviours of peers, by reason
+	bans              *metrics.Counter    // peers banned for misbehaving
+}
+
+// newMinerMetrics - registers all metrics of a miner.
+func newMinerMetrics(m *Miner) *minerMetrics {
+	registry := metrics.NewRegistry()
+	mm := &minerMetrics{
+		registry:          registry,
+		hashes:            registry.Counter("miner_hashes_total", "Number of nonces tried while mining."),
+		blocksMined:       registry.Counter("miner_blocks_mined_total", "Number of blocks mined by this miner."),
+		broadcastsSent:    registry.Counter("miner_broadcasts_sent_total", "Number of broadcasts sent to peers."),
+		broadcastsFailed:  registry.Counter("miner_broadcasts_failed_total", "Number of broadcasts to peers that failed."),
+		broadcastResults:  registry.CounterVec("miner_broadcast_results_total", "Number of results reported by peers for broadcasts.", "result", "reason"),
+		blocksAccepted:    registry.Counter("miner_blocks_accepted_total", "Number of blocks adopted from peers' broadcasts."),
+		blocksRejected:    registry.CounterVec("miner_blocks_rejected_total", "Number of broadcasts from peers that were rejected as invalid.", "reason"),
+		broadcastsIgnored: registry.CounterVec("miner_broadcasts_ignored_total", "Number of broadcasts from peers that were ignored.", "reason"),
+		reorgDepth:        registry.Histogram("miner_reorg_depth", "Number of blocks discarded by a reorg.", []float64{1, 2, 3, 5, 8, 13, 21}),
+		syncLatency:       registry.Histogram("miner_sync_latency_seconds", "Latency of /sync requests to peers.", []float64{.001, .005, .01, .05, .1, .5, 1}),
+		postsAnnounced:    registry.Counter("miner_posts_announced_total", "Number of post IDs announced to peers."),
+		postsRelayed:      registry.Counter("miner_posts_relayed_total", "Number of posts sent to peers that asked for them."),
+		penalties:         registry.CounterVec("miner_peer_penalties_total", "Number of misbehaviours of peers.", "reason"),
+		bans:              registry.Counter("miner_peer_bans_total", "Number of peers banned for misbehaving."),
+	}
+	registry.GaugeFunc("miner_height", "Length of the miner's blockchain.", func() float64 {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		return float64(len(m.blockChain))
+	})
+	registry.GaugeFunc("miner_pool_size", "Number of posts in the miner's pool.", func() float64 {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		return float64(m.pool.Size())
+	})
+	registry.GaugeFunc("miner_peers", "Number of peers returned by the last registration.", func() float64 {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		return float64(len(m.peers))
+	})
+	registry.GaugeFunc("miner_known_addresses", "Number of miners in the address book.", func() float64 {
+		return float64(len(m.book.list()))
+	})
+	return mm
+}
@@ -2,15 +2,22 @@ package miner
 
 import (
 	"blockchain/blockchain"
+	"blockchain/logging"
+	"blockchain/metrics"
+	"blockchain/tracker"
+	"blockchain/transport"
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
-	"fmt"
 	"github.com/emirpasic/gods/sets/treeset"
 	"github.com/emirpasic/gods/utils"
 	"github.com/gin-gonic/gin"
-	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -19,32 +26,225 @@ type PostsJson struct {
 	Posts []blockchain.PostBase64 `json:"posts"`
 }
 
+// BlockChainJson - body of /broadcast: the latest blocks of the sender's blockchain, from height Start on.
 type BlockChainJson struct {
+	Start      int                      `json:"start,omitempty"` // height of the first block in Blockchain
 	Blockchain []blockchain.BlockBase64 `json:"blockchain"`
 }
 
+// BroadcastAccepted - The receiver switched to the broadcast blockchain.
+const BroadcastAccepted = "accepted"
+
+// BroadcastIgnored - The broadcast blockchain is not better than the receiver's, or cannot be adopted through no fault
+// of the sender, so it is ignored.
+const BroadcastIgnored = "ignored"
+
+// BroadcastInvalid - The broadcast blockchain breaks a rule of the blockchain, so it is rejected.
+const BroadcastInvalid = "invalid"
+
+// BroadcastResultJson - response of /broadcast, /admin/import and POST /admin/snapshot.
+type BroadcastResultJson struct {
+	Result string `json:"result"`           // BroadcastAccepted, BroadcastIgnored or BroadcastInvalid
+	Reason string `json:"reason,omitempty"` // why the blockchain is ignored or invalid
+	Index  int    `json:"index"`            // offending block if invalid, fork if refused for finality, or -1
+}
+
+// SnapshotQuery - optional query parameters of GET /admin/snapshot.
+type SnapshotQuery struct {
+	Height int `form:"height"` // height of the snapshot, 0 means the height below which the miner has pruned its blocks
+}
+
+// ReadQuery - optional query parameters of /read. The zero value selects the complete blockchain.
+type ReadQuery struct {
+	From    int    `form:"from"`    // height of the first block to return
+	To      int    `form:"to"`      // only return blocks below this height, 0 means up to the tip
+	Limit   int    `form:"limit"`   // page size, 0 means returning the whole range at once
+	Cursor  int    `form:"cursor"`  // height to resume from, as returned in ReadJson.Next
+	Author  string `form:"author"`  // base64-encoded public key, only return posts written by this user
+	Since   int64  `form:"since"`   // only return posts with Timestamp >= Since, 0 means no lower bound
+	Until   int64  `form:"until"`   // only return posts with Timestamp < Until, 0 means no upper bound
+	Headers bool   `form:"headers"` // only return block headers without any posts
+}
+
+// ReadJson - response of /read.
+// Blocks in Blockchain are consecutive, starting from height Start. If the query filters posts by author or
+// timestamp, blocks are still returned with only the matching posts, so that their headers still form a chain.
+type ReadJson struct {
+	Height     int                      `json:"height"`           // length of the miner's complete blockchain
+	Start      int                      `json:"start"`            // height of the first block in Blockchain
+	Next       int                      `json:"next,omitempty"`   // cursor of the next page, 0 if this is the last page
+	Pruned     int                      `json:"pruned,omitempty"` // blocks below this height are returned without posts
+	Blockchain []blockchain.BlockBase64 `json:"blockchain"`
+}
+
+// ProofQuery - query parameters of /proof, which name a post by its user and timestamp, since no two posts of a
+// blockchain share both.
+type ProofQuery struct {
+	User      string `form:"user"`      // base64-encoded public key of the post's user
+	Timestamp int64  `form:"timestamp"` // timestamp of the post
+}
+
+// ProofJson - response of /proof.
+type ProofJson struct {
+	Height int                          `json:"height"` // height of the block that holds Post
+	Post   blockchain.PostBase64        `json:"post"`
+	Proof  blockchain.MerkleProofBase64 `json:"proof"` // proves that the summary of the block covers Post
+}
+
 // Miner - a Miner in the blockchain system.
 type Miner struct {
-	blockChain  []blockchain.Block // current blockchain
-	cmp         utils.Comparator   // comparator for posts and pool
-	posts       *treeset.Set       // all posts on the current blockchain, sorted by timestamp
-	pool        *treeset.Set       // posts to be posted to the blockchain
-	port        int                // http port
-	trackerPort int                // tracker's http port
-	router      *gin.Engine        // http router
-	server      *http.Server       // http server
-	lock        sync.RWMutex       // protects all writable fields
-	quit        chan struct{}      // notify the background routine to quit
+	blockChain  []blockchain.Block      // current blockchain, whose block hashes are memoised under the write lock
+	pruned      int                     // height below which blocks of blockChain hold their headers only
+	cmp         utils.Comparator        // comparator for posts and pool
+	posts       *treeset.Set            // stubs of all posts on the current blockchain, sorted by timestamp
+	pool        *treeset.Set            // posts to be posted to the blockchain
+	known       map[string]map[int]bool // peers known to have each post in the pool, by post ID
+	seen        *seenCache              // IDs of posts received recently
+	replays     *seenCache              // signatures of peer requests received recently
+	verified    *blockchain.VerifyCache // IDs of posts whose signatures have been verified recently
+	port        int                     // http port
+	trackerPort int                     // tracker's http port
+	router      *gin.Engine             // http router
+	server      *http.Server            // http server
+	lock        sync.RWMutex            // protects all writable fields
+	quit        chan struct{}           // notify the background routine to quit
+	peers       []int                   // peers returned by the last registration, or by the address book
+	book        *addressBook            // known miners, used when the tracker is unreachable
+	bookPath    string                  // file in which book persists, empty to keep it in memory only
+	started     time.Time               // when the miner started
+
+	subscribers map[chan EventJson]struct{} // channels of /events streams
+	subLock     sync.Mutex                  // protects subscribers
+
+	hashRate      float64          // hashes per second of the last mining round
+	lastSync      []PeerResultJson // results of the last round of syncing the pool
+	lastBroadcast []PeerResultJson // results of the last broadcast
+	statsLock     sync.Mutex       // protects hashRate, lastSync and lastBroadcast
+
+	nodeKey     ed25519.PrivateKey    // signs requests to peers
+	nodes       map[int]string        // node IDs of peers by port, learnt from their signed requests and confirmed on /status
+	binding     map[int]bool          // ports whose node IDs are being confirmed
+	scores      map[string]*peerScore // misbehaviour records of peers by node ID
+	bannedPorts map[int]string        // ports bound to nodes when they were banned, to the node IDs of those nodes
+	scoreLock   sync.Mutex            // protects nodes, binding, scores and bannedPorts
+
+	network   blockchain.Network // network whose chain the miner mines
+	networkID string             // ID of network, sent to the tracker and peers
+	genesis   []byte             // identity hash of network's genesis block
+	finality  int                // maximum number of blocks that a reorg may discard
+	pruning   int                // number of latest blocks whose posts are kept, 0 to keep the posts of all blocks
+
+	adminToken string // bearer token of the /admin APIs, empty to serve them to local clients only
+
+	tls     *transport.Config // TLS settings, nil for plain HTTP
+	client  *http.Client      // sends requests to the tracker and peers
+	metrics *minerMetrics     // metrics exposed on /metrics
+	logger  *slog.Logger      // logger carrying the miner's port in every record
+}
+
+// Option - an optional setting of NewMiner.
+type Option func(m *Miner)
+
+// WithLogger - sends the miner's logs to logger instead of slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(m *Miner) {
+		m.logger = logger
+	}
+}
+
+// WithTLS - serves the miner's APIs over TLS, and connects to the tracker and peers over TLS. All nodes of a network
+// must agree on whether TLS is used.
+func WithTLS(config *transport.Config) Option {
+	return func(m *Miner) {
+		m.tls = config
+	}
+}
+
+// WithAddressBook - keeps the addresses of known miners in the file at path, so that they survive restarts.
+func WithAddressBook(path string) Option {
+	return func(m *Miner) {
+		m.bookPath = path
+	}
+}
+
+// WithNodeKey - sets the key that identifies the miner to its peers, instead of a newly generated one.
+func WithNodeKey(key ed25519.PrivateKey) Option {
+	return func(m *Miner) {
+		m.nodeKey = key
+	}
+}
+
+// WithNetwork - joins network instead of blockchain.MainNetwork.
+func WithNetwork(network blockchain.Network) Option {
+	return func(m *Miner) {
+		m.network = network
+	}
+}
+
+// WithFinalityDepth - refuses broadcasts that would discard more than depth blocks, instead of FinalityDepth. A deeper
+// depth lets longer partitions heal, and lets a burst of hash power rewrite more blocks.
+func WithFinalityDepth(depth int) Option {
+	return func(m *Miner) {
+		m.finality = depth
+	}
+}
+
+// WithPruning - keeps the posts of only the latest depth blocks, and the headers of all older blocks. depth is raised
+// to the finality depth if it is lower, since a reorg needs the posts of the blocks it discards. A pruning miner can
+// no longer export its blockchain, but serves snapshots on /admin/snapshot.
+func WithPruning(depth int) Option {
+	return func(m *Miner) {
+		m.pruning = depth
+	}
+}
+
+// WithAdminToken - serves the /admin APIs to clients that send token as a bearer token in the Authorization header,
+// from any host. Without a token, the /admin APIs are only served to clients on the miner's own host.
+func WithAdminToken(token string) Option {
+	return func(m *Miner) {
+		m.adminToken = token
+	}
 }
 
 // NewMiner - creates a new Miner, but does not start its http server and background routine yet.
-func NewMiner(port int, trackerPort int) *Miner {
+func NewMiner(port int, trackerPort int, options ...Option) *Miner {
 	miner := &Miner{
 		router:      gin.New(),
 		port:        port,
 		trackerPort: trackerPort,
 		quit:        make(chan struct{}),
+		subscribers: make(map[chan EventJson]struct{}),
+		known:       make(map[string]map[int]bool),
+		seen:        newSeenCache(SeenCacheSize),
+		replays:     newSeenCache(ReplayCacheSize),
+		verified:    blockchain.NewVerifyCache(VerifyCacheSize),
+		nodes:       make(map[int]string),
+		binding:     make(map[int]bool),
+		scores:      make(map[string]*peerScore),
+		bannedPorts: make(map[int]string),
+		network:     blockchain.MainNetwork,
+		finality:    FinalityDepth,
+		logger:      slog.Default(),
+	}
+	for _, option := range options {
+		option(miner)
+	}
+	if miner.pruning > 0 {
+		miner.pruning = max(miner.pruning, miner.finality)
 	}
+	miner.networkID = miner.network.ID()
+	miner.genesis = miner.network.GenesisHash()
+	if miner.nodeKey == nil {
+		_, miner.nodeKey, _ = ed25519.GenerateKey(rand.Reader)
+	}
+	miner.client = miner.tls.Client()
+	miner.logger = miner.logger.With("node", "miner", "port", port)
+	book, err := newAddressBook(miner.bookPath, port)
+	if err != nil {
+		miner.logger.Warn("failed to load address book", "path", miner.bookPath, "error", err)
+	}
+	miner.book = book
+	miner.router.Use(logging.Middleware(miner.logger))
 	miner.cmp = func(a, b any) int {
 		post1 := a.(blockchain.Post)
 		post2 := b.(blockchain.Post)
@@ -61,20 +261,19 @@ func NewMiner(port int, trackerPort int) *Miner {
 	}
 	miner.posts = treeset.NewWith(miner.cmp)
 	miner.pool = treeset.NewWith(miner.cmp)
+	miner.metrics = newMinerMetrics(miner)
 
 	miner.registerAPIs()
-	miner.server = &http.Server{
-		Addr:    fmt.Sprintf("localhost:%d", port),
-		Handler: miner.router,
-	}
+	miner.server = transport.NewServer(port, miner.router)
 	return miner
 }
 
 // Start - starts the Miner's background routine and http server.
 func (m *Miner) Start() {
+	m.started = time.Now()
 	go func() {
-		if err := m.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("listen: %s\n", err)
+		if err := m.tls.ListenAndServe(m.server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			m.logger.Error("failed to listen", "error", err)
 		}
 	}()
 	go m.routine()
@@ -85,15 +284,19 @@ func (m *Miner) Shutdown() {
 	// first shutdown background routine
 	m.quit <- struct{}{}
 	<-m.quit
-	// then shutdown server
+	if err := m.book.save(); err != nil {
+		m.logger.Warn("failed to save address book", "path", m.book.path, "error", err)
+	}
+	// then end all event streams and shutdown server
+	m.unsubscribeAll()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := m.server.Shutdown(ctx); err != nil {
-		log.Println("error when shutting down server: ", err)
+		m.logger.Error("error when shutting down server", "error", err)
 	}
 	select {
 	case <-ctx.Done():
-		log.Println("shutting down server timeout")
+		m.logger.Error("shutting down server timeout")
 	default:
 		break
 	}
@@ -103,16 +306,55 @@ func (m *Miner) Shutdown() {
 func (m *Miner) registerAPIs() {
 	// register APIs
 	m.router.GET("/read", func(ctx *gin.Context) {
-		statusCode, response := m.readHandler()
+		var query ReadQuery
+		if err := ctx.BindQuery(&query); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "query has invalid format"})
+			return
+		}
+		statusCode, response := m.readHandler(query)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/proof", func(ctx *gin.Context) {
+		var query ProofQuery
+		if err := ctx.BindQuery(&query); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "query has invalid format"})
+			return
+		}
+		statusCode, response := m.proofHandler(query)
 		ctx.JSON(statusCode, response)
 	})
-	m.router.POST("/write", func(ctx *gin.Context) {
+	m.router.GET("/status", func(ctx *gin.Context) {
+		statusCode, response := m.statusHandler()
+		ctx.JSON(statusCode, response)
+	})
+	m.router.GET("/metrics", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+		ctx.Header("Content-Type", metrics.ContentType)
+		_, _ = m.metrics.registry.WriteTo(ctx.Writer)
+	})
+	m.router.GET("/events", func(ctx *gin.Context) {
+		var query EventsQuery
+		if err := ctx.BindQuery(&query); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "query has invalid format"})
+			return
+		}
+		m.eventsHandler(ctx, query)
+	})
+	m.router.POST("/write", transport.LimitBody(MaxWriteRequestSize), func(ctx *gin.Context) {
 		var encoded blockchain.PostBase64
-		if err := ctx.BindJSON(&encoded); err != nil {
+		if err := ctx.ShouldBindJSON(&encoded); err != nil {
+			if transport.TooLarge(err) {
+				ctx.JSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "request is too large"})
+				return
+			}
 			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "post has invalid format"})
 			return
 		}
 		post, err := encoded.DecodeBase64()
+		if errors.Is(err, blockchain.ErrWeakKey) {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "user key is weak"})
+			return
+		}
 		if err != nil {
 			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "post has invalid base64 string"})
 			return
@@ -120,9 +362,11 @@ func (m *Miner) registerAPIs() {
 		statusCode, response := m.writeHandler(post)
 		ctx.JSON(statusCode, response)
 	})
-	m.router.POST("/sync", func(ctx *gin.Context) {
+	m.router.POST("/sync", m.peerGuard, func(ctx *gin.Context) {
+		peer := peerID(ctx)
 		var request PostsJson
 		if err := ctx.BindJSON(&request); err != nil {
+			m.penalize(peer, "format")
 			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
 			return
 		}
@@ -130,30 +374,138 @@ func (m *Miner) registerAPIs() {
 		for _, encoded := range request.Posts {
 			post, err := encoded.DecodeBase64()
 			if err != nil {
+				m.penalize(peer, "encoding")
 				ctx.JSON(http.StatusBadRequest, map[string]string{"error": "post has invalid base64 string"})
 				return
 			}
 			posts = append(posts, post)
 		}
-		statusCode, response := m.syncHandler(posts)
+		sender := m.boundSender(ctx)
+		statusCode, response := m.syncHandler(peer, sender, posts)
 		ctx.JSON(statusCode, response)
 	})
-	m.router.POST("/broadcast", func(ctx *gin.Context) {
-		var request BlockChainJson
+	m.router.POST("/inv", m.peerGuard, func(ctx *gin.Context) {
+		peer := peerID(ctx)
+		var request InventoryJson
 		if err := ctx.BindJSON(&request); err != nil {
+			m.penalize(peer, "format")
 			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
 			return
 		}
+		ids := make([][]byte, 0, len(request.IDs))
+		for _, encoded := range request.IDs {
+			id, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				m.penalize(peer, "encoding")
+				ctx.JSON(http.StatusBadRequest, map[string]string{"error": "post ID has invalid base64 string"})
+				return
+			}
+			ids = append(ids, id)
+		}
+		sender := m.boundSender(ctx)
+		statusCode, response := m.invHandler(sender, ids)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.POST("/broadcast", m.peerGuard, func(ctx *gin.Context) {
+		peer := peerID(ctx)
+		var request BlockChainJson
+		if err := ctx.BindJSON(&request); err != nil {
+			statusCode, response := m.rejectBroadcast(peer, "format", -1)
+			ctx.JSON(statusCode, response)
+			return
+		}
+		if request.Start < 0 {
+			statusCode, response := m.rejectBroadcast(peer, "format", -1)
+			ctx.JSON(statusCode, response)
+			return
+		}
 		chain := make([]blockchain.Block, 0)
-		for _, encoded := range request.Blockchain {
+		for i, encoded := range request.Blockchain {
 			block, err := encoded.DecodeBase64()
+			if errors.Is(err, blockchain.ErrWeakKey) {
+				statusCode, response := m.rejectBroadcast(peer, "weak-key", request.Start+i)
+				ctx.JSON(statusCode, response)
+				return
+			}
 			if err != nil {
-				ctx.JSON(http.StatusBadRequest, map[string]string{"error": "block has invalid base64 string"})
+				statusCode, response := m.rejectBroadcast(peer, "encoding", request.Start+i)
+				ctx.JSON(statusCode, response)
 				return
 			}
 			chain = append(chain, block)
 		}
-		statusCode, response := m.broadcastHandler(chain)
+		statusCode, response := m.broadcastHandler(peer, m.boundSender(ctx), request.Start, chain)
+		ctx.JSON(statusCode, response)
+	})
+	m.router.POST("/peers", m.peerGuard, func(ctx *gin.Context) {
+		peer := peerID(ctx)
+		var request tracker.PortsJson
+		if err := ctx.BindJSON(&request); err != nil {
+			m.penalize(peer, "format")
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "request has invalid format"})
+			return
+		}
+		sender, _ := strconv.Atoi(ctx.GetHeader(PeerHeader))
+		statusCode, response := m.peersHandler(sender, request.Ports)
+		ctx.JSON(statusCode, response)
+	})
+
+	// register admin APIs
+	admin := m.router.Group("/admin", m.adminGuard)
+	admin.GET("/bans", func(ctx *gin.Context) {
+		statusCode, response := m.bansHandler()
+		ctx.JSON(statusCode, response)
+	})
+	admin.DELETE("/bans", func(ctx *gin.Context) {
+		statusCode, response := m.clearBansHandler("")
+		ctx.JSON(statusCode, response)
+	})
+	admin.DELETE("/bans/:peer", func(ctx *gin.Context) {
+		statusCode, response := m.clearBansHandler(ctx.Param("peer"))
+		ctx.JSON(statusCode, response)
+	})
+	admin.GET("/export", func(ctx *gin.Context) {
+		statusCode, response := m.exportHandler()
+		chain, ok := response.([]blockchain.Block)
+		if !ok {
+			ctx.JSON(statusCode, response)
+			return
+		}
+		ctx.Header("Content-Type", "application/octet-stream")
+		ctx.Status(statusCode)
+		if err := blockchain.ExportChain(ctx.Writer, &m.network, chain); err != nil {
+			m.logger.Warn("failed to export the blockchain", "error", err)
+		}
+	})
+	admin.POST("/import", transport.LimitBody(MaxImportRequestSize), func(ctx *gin.Context) {
+		statusCode, response := m.importHandler(ctx.Request.Body)
+		ctx.JSON(statusCode, response)
+	})
+	admin.GET("/snapshot", func(ctx *gin.Context) {
+		var query SnapshotQuery
+		if err := ctx.BindQuery(&query); err != nil {
+			ctx.JSON(http.StatusBadRequest, map[string]string{"error": "query has invalid format"})
+			return
+		}
+		statusCode, response := m.snapshotHandler(query)
+		ctx.JSON(statusCode, response)
+	})
+	admin.POST("/snapshot", transport.LimitBody(MaxSnapshotRequestSize), func(ctx *gin.Context) {
+		var encoded blockchain.SnapshotBase64
+		if err := ctx.BindJSON(&encoded); err != nil {
+			ctx.JSON(http.StatusBadRequest, BroadcastResultJson{Result: BroadcastInvalid, Reason: "format", Index: -1})
+			return
+		}
+		snapshot, err := encoded.DecodeBase64()
+		if errors.Is(err, blockchain.ErrWeakKey) {
+			ctx.JSON(http.StatusBadRequest, BroadcastResultJson{Result: BroadcastInvalid, Reason: "weak-key", Index: -1})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, BroadcastResultJson{Result: BroadcastInvalid, Reason: "encoding", Index: -1})
+			return
+		}
+		statusCode, response := m.bootstrapHandler(snapshot)
 		ctx.JSON(statusCode, response)
 	})
 }
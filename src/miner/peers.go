@@ -0,0 +1,345 @@
+package miner
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PeerHeader - Header in which a miner declares its own http port when sending signed requests to peers.
+const PeerHeader = "X-Peer-Port"
+
+// MaxPeerRequestSize - Maximum size in bytes of a /sync or /broadcast request body.
+const MaxPeerRequestSize = 16 << 20
+
+// maxOversizedRead - The rest of a body larger than MaxPeerRequestSize is hashed up to this many more bytes, so that the
+// signature of the request can be verified before its sender is penalized. Larger bodies are dropped unverified.
+const maxOversizedRead = MaxPeerRequestSize
+
+// nodeStatusTimeout - How long a miner waits for a peer to confirm its node ID on /status.
+const nodeStatusTimeout = 5 * time.Second
+
+// BanThreshold - A peer is banned once its misbehaviour score reaches BanThreshold.
+const BanThreshold = 100
+
+// BanDuration - A banned peer's requests are refused for BanDuration.
+const BanDuration = 10 * time.Minute
+
+// ScoreHalfLife - A peer's misbehaviour score halves every ScoreHalfLife, so that occasional faults are forgiven.
+const ScoreHalfLife = time.Minute
+
+// PenaltyInvalidBlock - Score added when a peer broadcasts a blockchain that breaks a rule.
+// Honest miners never do so, so it is banned at once.
+const PenaltyInvalidBlock = BanThreshold
+
+// PenaltyInvalidPost - Score added when a peer syncs a post with an invalid signature.
+const PenaltyInvalidPost = 60
+
+// PenaltyMalformed - Score added when a peer sends a request that cannot be decoded.
+const PenaltyMalformed = 20
+
+// PenaltyOversized - Score added when a peer sends a request larger than MaxPeerRequestSize.
+// A single one is not a ban, since a peer running with a larger limit may send it in good faith.
+const PenaltyOversized = 40
+
+// peerKey - key of the verified node ID of the sender in the gin context of a peer request.
+const peerKey = "peer"
+
+// peerScore - misbehaviour record of one peer.
+type peerScore struct {
+	score       float64   // misbehaviour score as of updated
+	updated     time.Time // when score was last decayed
+	bannedUntil time.Time // zero if the peer has never been banned
+	reason      string    // the last misbehaviour
+}
+
+// BanJson - a peer's misbehaviour record, as listed by /admin/bans.
+type BanJson struct {
+	Peer        string  `json:"peer"`
+	Score       float64 `json:"score"`           // current misbehaviour score
+	Banned      bool    `json:"banned"`          // whether requests from the peer are refused
+	BannedUntil int64   `json:"banned-until"`    // unix time in milliseconds, 0 if never banned
+	Reason      string  `json:"reason"`          // the last misbehaviour
+	Ports       []int   `json:"ports,omitempty"` // ports bound to the peer when it was banned, which are banned with it
+}
+
+// peerID - the node ID of the sender of a peer request, as verified by peerGuard.
+func peerID(ctx *gin.Context) string {
+	return ctx.GetString(peerKey)
+}
+
+// decay - brings a score up to date.
+func (s *peerScore) decay(now time.Time) {
+	s.score *= math.Pow(0.5, float64(now.Sub(s.updated))/float64(ScoreHalfLife))
+	s.updated = now
+}
+
+// penalize - adds the penalty of a misbehaviour to a peer's score, and bans it once the score reaches BanThreshold.
+// The ports bound to the peer are banned with it, so that it cannot come back with a new node key on the same port.
+func (m *Miner) penalize(peer string, reason string) {
+	points := penaltyOf(reason)
+	if points == 0 {
+		return
+	}
+	m.scoreLock.Lock()
+	defer m.scoreLock.Unlock()
+	now := time.Now()
+	record, ok := m.scores[peer]
+	if !ok {
+		record = &peerScore{updated: now}
+		m.scores[peer] = record
+	}
+	record.decay(now)
+	record.score += points
+	record.reason = reason
+	m.metrics.penalties.With(reason).Inc()
+	if record.score >= BanThreshold && !now.Before(record.bannedUntil) {
+		record.bannedUntil = now.Add(BanDuration)
+		for port, node := range m.nodes {
+			if node == peer {
+				m.bannedPorts[port] = peer
+			}
+		}
+		m.metrics.bans.Inc()
+		m.logger.Warn("banned a misbehaving peer", "peer", peer, "score", record.score, "reason", reason)
+	}
+}
+
+// banned - checks whether requests from a peer are currently refused, either because its node is banned or because it
+// declares a port that was bound to a banned node.
+func (m *Miner) banned(peer string, port int) bool {
+	m.scoreLock.Lock()
+	defer m.scoreLock.Unlock()
+	return m.nodeBanned(peer) || m.portBanned(port)
+}
+
+// nodeBanned - checks whether a node is currently banned. The caller must hold scoreLock.
+func (m *Miner) nodeBanned(peer string) bool {
+	record, ok := m.scores[peer]
+	return ok && time.Now().Before(record.bannedUntil)
+}
+
+// portBanned - checks whether port was bound to a node that is still banned, and forgets the port once the ban of its
+// node is over or cleared. The caller must hold scoreLock.
+func (m *Miner) portBanned(port int) bool {
+	peer, ok := m.bannedPorts[port]
+	if ok && !m.nodeBanned(peer) {
+		delete(m.bannedPorts, port)
+		return false
+	}
+	return ok
+}
+
+// unbannedPeers - filters out peers whose node or port is banned, so that no requests are sent to them.
+// A peer's node is known once it has sent a signed request and the miner on its port has confirmed the node ID.
+func (m *Miner) unbannedPeers(peers []int) []int {
+	m.scoreLock.Lock()
+	defer m.scoreLock.Unlock()
+	result := make([]int, 0, len(peers))
+	for _, peer := range peers {
+		if node, ok := m.nodes[peer]; (!ok || !m.nodeBanned(node)) && !m.portBanned(peer) {
+			result = append(result, peer)
+		}
+	}
+	return result
+}
+
+// peerGuard - middleware of peer APIs, refusing unsigned requests, banned nodes and ports, nodes of other networks and
+// bodies larger than MaxPeerRequestSize. Nothing is penalized before the signature is verified, since the sender is not
+// known until then; the rest of an oversized body is hashed to verify it, and then its sender is penalized.
+// Node IDs are keys that nodes generate themselves, so bans are best-effort: a banned node that generates a new key and
+// declares a port that was never bound to it is a new peer.
+func (m *Miner) peerGuard(ctx *gin.Context) {
+	key, err := nodeKeyOf(ctx.Request)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	peer := NodeID(key)
+	port, portErr := strconv.Atoi(ctx.GetHeader(PeerHeader))
+	if m.banned(peer, port) {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "peer is banned"})
+		return
+	}
+	digest := sha256.New()
+	body, err := io.ReadAll(io.TeeReader(io.LimitReader(ctx.Request.Body, MaxPeerRequestSize+1), digest))
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusBadRequest, map[string]string{"error": "failed to read request"})
+		return
+	}
+	oversized := len(body) > MaxPeerRequestSize
+	if oversized {
+		body = nil
+		if n, err := io.Copy(digest, io.LimitReader(ctx.Request.Body, maxOversizedRead+1)); err != nil || n > maxOversizedRead {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "request is too large"})
+			return
+		}
+	}
+	if err := verifyRequest(ctx.Request, key, digest.Sum(nil), m.replays); err != nil {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		return
+	}
+	if oversized {
+		m.penalize(peer, "oversized")
+		ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "request is too large"})
+		return
+	}
+	if ctx.GetHeader(NetworkHeader) != m.networkID {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, map[string]string{"error": "peer is on another network"})
+		return
+	}
+	if portErr == nil {
+		m.bindNode(port, peer)
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	ctx.Set(peerKey, peer)
+	ctx.Next()
+}
+
+// bindNode - binds port to the node ID of a peer that declares it, once the miner listening on port confirms the node
+// ID on /status. The declared port is only signed by the sender itself, so a node cannot otherwise be told from one that
+// claims its port to get it filtered out by unbannedPeers. Confirmation runs in the background, once at a time per port.
+func (m *Miner) bindNode(port int, peer string) {
+	m.scoreLock.Lock()
+	bound, pending := m.nodes[port] == peer, m.binding[port]
+	if !bound && !pending {
+		m.binding[port] = true
+	}
+	m.scoreLock.Unlock()
+	if bound {
+		m.book.markSeen(port)
+	}
+	if bound || pending {
+		return
+	}
+	go func() {
+		confirmed := m.nodeOf(port) == peer
+		m.scoreLock.Lock()
+		delete(m.binding, port)
+		if confirmed {
+			m.nodes[port] = peer
+			// the node may have been banned while its port was being confirmed
+			if m.nodeBanned(peer) {
+				m.bannedPorts[port] = peer
+			}
+		}
+		m.scoreLock.Unlock()
+		if confirmed {
+			m.book.markSeen(port)
+		}
+	}()
+}
+
+// boundSender - the port declared by the sender of a peer request if it is bound to the sender's node ID, or 0 if it is
+// not, since until then the port is only the sender's claim.
+func (m *Miner) boundSender(ctx *gin.Context) int {
+	port, err := strconv.Atoi(ctx.GetHeader(PeerHeader))
+	if err != nil {
+		return 0
+	}
+	m.scoreLock.Lock()
+	defer m.scoreLock.Unlock()
+	if m.nodes[port] != peerID(ctx) {
+		return 0
+	}
+	return port
+}
+
+// nodeOf - the node ID that the miner listening on port reports on /status, or "" if it cannot be read.
+func (m *Miner) nodeOf(port int) string {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeStatusTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.tls.URL(port, "/status"), nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer resp.Body.Close()
+	var status StatusJson
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&status) != nil {
+		return ""
+	}
+	return status.NodeID
+}
+
+// penaltyOf - the score added to a peer for a misbehaviour.
+func penaltyOf(reason string) float64 {
+	switch reason {
+	case "oversized":
+		return PenaltyOversized
+	case "format", "encoding":
+		return PenaltyMalformed
+	case "invalid-post":
+		return PenaltyInvalidPost
+	case "future":
+		// the peer's clock may just be ahead, and the chain becomes valid later
+		return 0
+	case "gap":
+		// the peer may just be far ahead of this miner, which has fallen behind
+		return 0
+	case "pruned":
+		// the peer has pruned the posts of blocks that this miner lacks
+		return 0
+	default:
+		return PenaltyInvalidBlock
+	}
+}
+
+// bansHandler - handles GET /admin/bans
+// lists the misbehaviour records of all peers, sorted by score from the highest
+func (m *Miner) bansHandler() (int, any) {
+	m.scoreLock.Lock()
+	defer m.scoreLock.Unlock()
+	now := time.Now()
+	bans := make([]BanJson, 0, len(m.scores))
+	for peer, record := range m.scores {
+		record.decay(now)
+		ban := BanJson{Peer: peer, Score: record.score, Banned: now.Before(record.bannedUntil), Reason: record.reason}
+		if !record.bannedUntil.IsZero() {
+			ban.BannedUntil = record.bannedUntil.UnixMilli()
+		}
+		if ban.Banned {
+			for port, node := range m.bannedPorts {
+				if node == peer {
+					ban.Ports = append(ban.Ports, port)
+				}
+			}
+			sort.Ints(ban.Ports)
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Score > bans[j].Score
+	})
+	return http.StatusOK, bans
+}
+
+// clearBansHandler - handles DELETE /admin/bans and DELETE /admin/bans/:peer
+// forgets the misbehaviour of one peer, or of all peers if peer is empty
+func (m *Miner) clearBansHandler(peer string) (int, any) {
+	m.scoreLock.Lock()
+	defer m.scoreLock.Unlock()
+	if peer == "" {
+		m.scores = make(map[string]*peerScore)
+		m.bannedPorts = make(map[int]string)
+		m.logger.Info("cleared all bans")
+		return http.StatusOK, nil
+	}
+	if _, ok := m.scores[peer]; !ok {
+		return http.StatusNotFound, map[string]string{"error": "peer has no record"}
+	}
+	delete(m.scores, peer)
+	m.logger.Info("cleared ban", "peer", peer)
+	return http.StatusOK, nil
+}
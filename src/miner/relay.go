@@ -0,0 +1,227 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+)
+
+// RelayFanout - In each round of relaying, posts are announced to at most RelayFanout peers.
+const RelayFanout = 3
+
+// SeenCacheSize - Number of post IDs remembered by the seen-cache.
+const SeenCacheSize = 10000
+
+// MaxInventorySize - A single /inv request announces at most MaxInventorySize post IDs.
+const MaxInventorySize = 1000
+
+// InventoryJson - request and response of /inv: IDs of posts that the sender has, or that the receiver wants.
+type InventoryJson struct {
+	IDs []string `json:"ids"` // base64-encoded post IDs
+}
+
+// seenCache - IDs that have been received recently: of posts, so that they are not requested again, or of signed peer
+// requests, so that they are not replayed. The oldest IDs are evicted first once the cache is full.
+type seenCache struct {
+	ids   map[string]struct{}
+	order []string // ring buffer of ids in the order they were added
+	next  int      // position in order of the next ID to add
+	lock  sync.Mutex
+}
+
+// newSeenCache - creates an empty seenCache that holds size IDs at most.
+func newSeenCache(size int) *seenCache {
+	return &seenCache{ids: make(map[string]struct{}), order: make([]string, size)}
+}
+
+// add - remembers an ID, evicting the oldest one if the cache is full. Returns false if the ID was already remembered.
+func (c *seenCache) add(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	if old := c.order[c.next]; old != "" {
+		delete(c.ids, old)
+	}
+	c.order[c.next] = id
+	c.ids[id] = struct{}{}
+	c.next = (c.next + 1) % len(c.order)
+	return true
+}
+
+// contains - checks whether an ID has been seen recently.
+func (c *seenCache) contains(id string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.ids[id]
+	return ok
+}
+
+// postID - the ID of a post as a map key.
+func postID(post blockchain.Post) string {
+	return string(post.ID())
+}
+
+// markKnown - records that a peer has the posts with the given IDs, so that they are not announced to it again.
+// A peer whose port is not bound to its node ID is passed as 0, and nothing is recorded for it.
+// Must be called with m.lock held.
+func (m *Miner) markKnown(peer int, ids ...string) {
+	if peer == 0 {
+		return
+	}
+	for _, id := range ids {
+		if peers, ok := m.known[id]; ok {
+			peers[peer] = true
+		}
+	}
+}
+
+// relay - announces the posts in the pool to at most RelayFanout peers that are not known to have them yet, and sends
+// each peer the posts it asks for. A post stops being announced once every peer has it or once it leaves the pool.
+func (m *Miner) relay(peers []int) {
+	m.lock.Lock()
+	inPool := make(map[string]blockchain.Post)
+	iter := m.pool.Iterator()
+	for iter.Next() {
+		post := iter.Value().(blockchain.Post)
+		id := postID(post)
+		inPool[id] = post
+		if _, ok := m.known[id]; !ok {
+			m.known[id] = make(map[int]bool)
+		}
+	}
+	// forget posts that have left the pool
+	for id := range m.known {
+		if _, ok := inPool[id]; !ok {
+			delete(m.known, id)
+		}
+	}
+	// gather what each peer lacks
+	missing := make(map[int][]blockchain.Post)
+	targets := make([]int, 0)
+	for _, peer := range peers {
+		for id, post := range inPool {
+			if !m.known[id][peer] && len(missing[peer]) < MaxInventorySize {
+				missing[peer] = append(missing[peer], post)
+			}
+		}
+		if len(missing[peer]) > 0 {
+			targets = append(targets, peer)
+		}
+	}
+	m.lock.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+	rand.Shuffle(len(targets), func(i, j int) {
+		targets[i], targets[j] = targets[j], targets[i]
+	})
+	if len(targets) > RelayFanout {
+		targets = targets[:RelayFanout]
+	}
+
+	// relay in parallel
+	wg := sync.WaitGroup{}
+	results := make([]PeerResultJson, len(targets))
+	for i, peer := range targets {
+		i, peer := i, peer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = newPeerResult(peer, m.announceTo(peer, missing[peer]))
+		}()
+	}
+	wg.Wait()
+	m.statsLock.Lock()
+	m.lastSync = results
+	m.statsLock.Unlock()
+}
+
+// announceTo - announces posts to a peer with /inv, and sends the ones it asks for with /sync.
+func (m *Miner) announceTo(peer int, posts []blockchain.Post) error {
+	byID := make(map[string]blockchain.Post, len(posts))
+	request := InventoryJson{IDs: make([]string, 0, len(posts))}
+	for _, post := range posts {
+		id := postID(post)
+		byID[id] = post
+		request.IDs = append(request.IDs, base64.StdEncoding.EncodeToString([]byte(id)))
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := m.postToPeer(peer, "/inv", data)
+	if err != nil {
+		m.logger.Warn("error when announcing posts to peer", "peer", peer, "error", err)
+		return err
+	}
+	defer resp.Body.Close()
+	var response InventoryJson
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&response) != nil {
+		m.logger.Warn("peer rejected announcement", "peer", peer, "status", resp.StatusCode)
+		return fmt.Errorf("peer responded with status code %d", resp.StatusCode)
+	}
+	m.metrics.postsAnnounced.Add(uint64(len(request.IDs)))
+
+	// the peer has every post it does not ask for
+	wanted := make(map[string]bool)
+	delivery := PostsJson{}
+	for _, encoded := range response.IDs {
+		id, err := base64.StdEncoding.DecodeString(encoded)
+		if post, ok := byID[string(id)]; err == nil && ok && !wanted[string(id)] {
+			wanted[string(id)] = true
+			delivery.Posts = append(delivery.Posts, post.EncodeBase64())
+		}
+	}
+	have := make([]string, 0, len(byID))
+	for id := range byID {
+		if !wanted[id] {
+			have = append(have, id)
+		}
+	}
+	m.lock.Lock()
+	m.markKnown(peer, have...)
+	m.lock.Unlock()
+	if len(delivery.Posts) == 0 {
+		return nil
+	}
+
+	data, err = json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	if err := m.syncWith(peer, data); err != nil {
+		return err
+	}
+	m.metrics.postsRelayed.Add(uint64(len(delivery.Posts)))
+	m.lock.Lock()
+	for id := range wanted {
+		m.markKnown(peer, id)
+	}
+	m.lock.Unlock()
+	return nil
+}
+
+// invHandler - handles /inv request from a peer miner
+// records that the peer listening on sender has the announced posts, unless sender is 0 because the port is not bound
+// to the peer's node ID, and returns the IDs of those that this miner has not seen
+func (m *Miner) invHandler(sender int, ids [][]byte) (int, any) {
+	if len(ids) > MaxInventorySize {
+		return http.StatusBadRequest, map[string]string{"error": "too many post IDs"}
+	}
+	wanted := make([]string, 0)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, id := range ids {
+		m.markKnown(sender, string(id))
+		if !m.seen.contains(string(id)) {
+			wanted = append(wanted, base64.StdEncoding.EncodeToString(id))
+		}
+	}
+	return http.StatusOK, InventoryJson{IDs: wanted}
+}
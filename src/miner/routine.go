@@ -2,11 +2,14 @@ package miner
 
 import (
 	"blockchain/blockchain"
+	"blockchain/logging"
 	"blockchain/tracker"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
 	"net/http"
 	"sync"
@@ -31,18 +34,64 @@ const MiningIterations = 10000
 // PostsPerBlock - Miner will pack at most PostsPerBlock posts to each block.
 const PostsPerBlock = 2
 
+// ExchangeMin - Miner's peer exchange interval is randomly chosen from ExchangeMin to ExchangeMax.
+const ExchangeMin = 2000
+
+// ExchangeMax - Miner's peer exchange interval is randomly chosen from ExchangeMin to ExchangeMax.
+const ExchangeMax = 4000
+
+// MaxWriteRequestSize - Maximum size in bytes of a /write request body, enough for a post of MaxContentSize.
+const MaxWriteRequestSize = 64 * 1024
+
+// MaxImportRequestSize - Maximum size in bytes of an /admin/import request body.
+const MaxImportRequestSize = 64 << 20
+
+// MaxSnapshotRequestSize - Maximum size in bytes of a POST /admin/snapshot request body.
+const MaxSnapshotRequestSize = 256 << 20
+
+// MaxReadLimit - A single /read request returns at most MaxReadLimit blocks when it asks for pagination.
+const MaxReadLimit = 100
+
+// BroadcastBlocks - A broadcast carries the latest BroadcastBlocks blocks at most, so that its size does not grow with
+// the blockchain. A receiver that needs earlier blocks reads them from the sender's /read API.
+const BroadcastBlocks = 16
+
+// FetchPageSize - The earlier blocks that a broadcast needs are read FetchPageSize blocks at a time, so that a page of
+// full blocks stays within MaxPeerRequestSize.
+const FetchPageSize = 32
+
+// MaxBroadcastGap - A broadcast whose first block is more than MaxBroadcastGap blocks above the receiver's blockchain is
+// refused, so that the blocks read from its sender are bounded. A miner that has fallen further behind its peers
+// catches up from a snapshot or an import instead.
+const MaxBroadcastGap = 64
+
+// fetchTimeout - How long a miner waits for each page of blocks that it reads from the sender of a broadcast.
+const fetchTimeout = 30 * time.Second
+
+// VerifyCacheSize - Number of verified post IDs remembered, so that the posts of broadcast blocks are not verified again
+// if they have been written to or synced with this miner before.
+const VerifyCacheSize = 100000
+
+// FinalityDepth - By default, a miner refuses broadcasts that would discard more than FinalityDepth of its blocks.
+// Parts of a partitioned network that each mine more than FinalityDepth blocks therefore never converge once the
+// partition ends: each refuses the other's blockchain and logs an alert on every broadcast, until the miners of one
+// part are restarted and bootstrapped from a snapshot of the other.
+const FinalityDepth = 6
+
 // routine - A miner's background routine.
 // Responsible for sending heartbeats to the tracker, syncing with peers and mining.
 // In one loop, routine will check if it needs to send heartbeats or syncs with peers, and then call mine() once.
 func (m *Miner) routine() {
 	heartbeatInterval := time.Duration(HeartbeatMin+rand.Intn(HeartbeatMax-HeartbeatMin)) * time.Millisecond
 	syncInterval := time.Duration(SyncMin+rand.Intn(SyncMax-SyncMin)) * time.Millisecond
+	exchangeInterval := time.Duration(ExchangeMin+rand.Intn(ExchangeMax-ExchangeMin)) * time.Millisecond
 
 	// register to the tracker immediately
 	peers := m.register()
 	// set up timers
 	heartbeatTimer := time.NewTimer(heartbeatInterval)
 	syncTimer := time.NewTimer(syncInterval)
+	exchangeTimer := time.NewTimer(exchangeInterval)
 
 loop:
 	for {
@@ -54,34 +103,18 @@ loop:
 				peers = m.register()
 				heartbeatTimer.Reset(heartbeatInterval)
 			case <-syncTimer.C:
-				// sync my pool with all peers, if I have at least one post
-				request := PostsJson{}
-				// gather all posts to send
-				m.lock.RLock()
-				iter := m.pool.Iterator()
-				for iter.Next() {
-					post := iter.Value().(blockchain.Post)
-					request.Posts = append(request.Posts, post.EncodeBase64())
-				}
-				m.lock.RUnlock()
-				if len(request.Posts) == 0 {
-					// no need to sync empty requests
-					syncTimer.Reset(syncInterval)
-					continue timerLoop
-				}
-				reqBytes, err := json.Marshal(request)
-				if err != nil {
-					log.Fatalf("failed to encode sync request")
+				// announce new posts to a few peers, which ask for the ones they lack
+				m.relay(m.unbannedPeers(peers))
+				syncTimer.Reset(syncInterval)
+			case <-exchangeTimer.C:
+				// exchange addresses with a random peer, and persist the address book
+				if targets := m.unbannedPeers(peers); len(targets) > 0 {
+					m.exchangeWith(targets[rand.Intn(len(targets))])
 				}
-				wg := sync.WaitGroup{}
-				// sync in parallel
-				for _, peer := range peers {
-					peer := peer
-					wg.Add(1)
-					go m.syncWith(peer, reqBytes, &wg)
+				if err := m.book.save(); err != nil {
+					m.logger.Warn("failed to save address book", "path", m.book.path, "error", err)
 				}
-				wg.Wait()
-				syncTimer.Reset(syncInterval)
+				exchangeTimer.Reset(exchangeInterval)
 			case <-m.quit:
 				break loop
 			default:
@@ -98,32 +131,52 @@ loop:
 	if !syncTimer.Stop() {
 		<-syncTimer.C
 	}
+	if !exchangeTimer.Stop() {
+		<-exchangeTimer.C
+	}
 	m.quit <- struct{}{}
 }
 
 // register - register this miner to the tracker. Also responsible for sending heartbeats to the tracker.
+// The tracker's list is authoritative while it is reachable; otherwise the miner keeps gossiping with the miners in its
+// address book. The returned peers are also kept for /status.
 func (m *Miner) register() []int {
-	request := tracker.PortJson{Port: m.port}
+	peers, err := m.fetchPeers()
+	if err == nil {
+		m.book.markSeen(peers...)
+	} else {
+		peers = m.book.list()
+	}
+	m.lock.Lock()
+	m.peers = peers
+	m.lock.Unlock()
+	return peers
+}
+
+// fetchPeers - sends a registration request to the tracker, and returns all other registered miners, or an error if
+// the tracker is unreachable.
+func (m *Miner) fetchPeers() ([]int, error) {
+	request := tracker.PortJson{Port: m.port, Network: m.networkID}
 	reqBytes, err := json.Marshal(request)
 	if err != nil {
-		log.Fatal("failed to encode register request to tracker")
+		m.logger.Error("failed to encode register request to tracker", "error", err)
+		return nil, err
 	}
-	url := fmt.Sprintf("http://localhost:%d/register", m.trackerPort)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
+	resp, err := m.client.Post(m.tls.URL(m.trackerPort, "/register"), "application/json", bytes.NewReader(reqBytes))
 	if err != nil {
-		log.Println("failed to send register request to tracker")
-		return nil
+		m.logger.Warn("failed to send register request to tracker", "tracker", m.trackerPort, "error", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Println("failed to register to server")
-		return nil
+		m.logger.Warn("failed to register to tracker", "tracker", m.trackerPort, "status", resp.StatusCode)
+		return nil, fmt.Errorf("tracker responded with status code %d", resp.StatusCode)
 	}
 	var response tracker.PortsJson
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
-		log.Printf("failed to decode registration response: %s", err.Error())
-		return nil
+		m.logger.Warn("failed to decode registration response", "tracker", m.trackerPort, "error", err)
+		return nil, err
 	}
 	peers := response.Ports
 	// delete myself from the response
@@ -136,36 +189,80 @@ func (m *Miner) register() []int {
 	if i < len(peers) {
 		peers = append(peers[:i], peers[i+1:]...)
 	}
-	return peers
+	return peers, nil
 }
 
-// syncWith - sync Miner's pool with one peer
-func (m *Miner) syncWith(peer int, data []byte, wg *sync.WaitGroup) {
-	defer wg.Done()
-	url := fmt.Sprintf("http://localhost:%d/sync", peer)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+// exchangeWith - sends the addresses known to this miner to a peer, and adds the addresses it knows to the book.
+func (m *Miner) exchangeWith(peer int) {
+	known := m.book.list()
+	if len(known) > MaxExchangeAddresses {
+		known = known[:MaxExchangeAddresses]
+	}
+	data, err := json.Marshal(tracker.PortsJson{Ports: known})
 	if err != nil {
-		log.Printf("error when syncing with peer %d: %s\n", peer, err.Error())
+		m.logger.Error("failed to encode peer exchange request", "error", err)
+		return
+	}
+	resp, err := m.postToPeer(peer, "/peers", data)
+	if err != nil {
+		m.logger.Warn("error when exchanging peers", "peer", peer, "error", err)
+		return
+	}
+	defer resp.Body.Close()
+	var response tracker.PortsJson
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&response) != nil {
+		m.logger.Warn("peer rejected peer exchange", "peer", peer, "status", resp.StatusCode)
 		return
 	}
+	m.book.learn(response.Ports)
+}
+
+// syncWith - sync Miner's pool with one peer
+func (m *Miner) syncWith(peer int, data []byte) error {
+	start := time.Now()
+	resp, err := m.postToPeer(peer, "/sync", data)
+	m.metrics.syncLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		m.logger.Warn("error when syncing with peer", "peer", peer, "error", err)
+		return err
+	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("failed to sync with peer %d\n", peer)
+		m.logger.Warn("failed to sync with peer", "peer", peer, "status", resp.StatusCode)
+		return fmt.Errorf("peer responded with status code %d", resp.StatusCode)
 	}
+	return nil
 }
 
 // mine - try to mine one block. It will try at most MiningIterations iterations before it returns.
 // If successful, it will broadcast the new block to peers, and append the new block to the local blockchain.
 func (m *Miner) mine(peers []int) {
+	m.lock.Lock()
+	m.dropStalePosts()
+	m.lock.Unlock()
 	m.lock.RLock()
 	length := len(m.blockChain)
+	// the block must be dated after the median time of the blocks before it
+	timestamp := time.Now().UnixNano()
+	if median := blockchain.MedianTimePast(m.blockChain); length > 0 && timestamp <= median {
+		timestamp = median + 1
+	}
 	// fill in the block that is to be mined
 	posts := make([]blockchain.Post, 0)
 	iter := m.pool.Iterator()
 	count := 0
+	size := 0
 	for iter.Next() {
 		post := iter.Value().(blockchain.Post)
+		if !post.VerifyTime(timestamp) {
+			continue
+		}
+		// the block must stay within MaxBlockSize
+		if size+post.Size() > blockchain.MaxBlockSize {
+			break
+		}
 		posts = append(posts, post)
+		size += post.Size()
 		count++
 		if count >= PostsPerBlock {
 			break
@@ -173,42 +270,32 @@ func (m *Miner) mine(peers []int) {
 	}
 	block := blockchain.Block{
 		Header: blockchain.BlockHeader{
-			PrevHash:  make([]byte, 32),
-			Summary:   blockchain.Hash(posts),
-			Timestamp: time.Now().UnixNano(),
+			PrevHash:  append(make([]byte, 0, 32), m.genesis...),
+			Summary:   blockchain.MerkleRoot(posts),
+			Timestamp: timestamp,
 		},
 		Posts: posts,
 	}
 	if len(m.blockChain) > 0 {
-		hash := blockchain.Hash(m.blockChain[len(m.blockChain)-1].Header)
-		copy(block.Header.PrevHash, hash)
+		copy(block.Header.PrevHash, m.blockChain[len(m.blockChain)-1].Hash())
 	}
 
 	success := false
-MineIter:
+	tried := 0
+	start := time.Now()
 	for i := 0; i < MiningIterations; i++ {
+		tried++
 		block.Header.Nonce = rand.Uint32()
-		hash := blockchain.Hash(block.Header)
-		zeroBytes := blockchain.TARGET / 8
-		zeroBits := blockchain.TARGET % 8
-		// the first zeroBytes bytes of hash must be zero
-		for i := 0; i < zeroBytes; i++ {
-			if hash[i] != 0 {
-				continue MineIter
-			}
-		}
-		// and then zeroBits bits of hash must be zero
-		if zeroBits > 0 {
-			nextByte := hash[zeroBytes]
-			nextByte = nextByte >> (8 - zeroBits)
-			if nextByte != 0 {
-				continue MineIter
-			}
+		if blockchain.MeetsTarget(block.Header.Hash()) {
+			success = true
+			break
 		}
-		success = true
-		break
 	}
 	m.lock.RUnlock()
+	m.statsLock.Lock()
+	m.hashRate = float64(tried) / time.Since(start).Seconds()
+	m.statsLock.Unlock()
+	m.metrics.hashes.Add(uint64(tried))
 	if !success {
 		return
 	}
@@ -221,13 +308,17 @@ MineIter:
 		m.lock.Unlock()
 		return
 	}
+	block.Hash() // memoised before other goroutines can read the block
 	m.blockChain = append(m.blockChain, block)
 	for _, post := range block.Posts {
-		m.posts.Add(post)
+		m.posts.Add(post.Stub())
 		m.pool.Remove(post)
 	}
-	request := BlockChainJson{}
-	for _, block := range m.blockChain {
+	m.publishBlocks(length)
+	m.prune()
+	m.metrics.blocksMined.Inc()
+	request := BlockChainJson{Start: max(len(m.blockChain)-BroadcastBlocks, 0)}
+	for _, block := range m.blockChain[request.Start:] {
 		request.Blockchain = append(request.Blockchain, block.EncodeBase64())
 	}
 	m.lock.Unlock()
@@ -236,32 +327,144 @@ MineIter:
 	for _, post := range block.Posts {
 		contents = append(contents, post.Body.Content)
 	}
-	log.Printf("%d: Mined a block with contents (%v), chain length %d\n", m.port, contents, len(request.Blockchain))
+	m.logger.Info("mined a block",
+		"height", request.Start+len(request.Blockchain),
+		"hash", logging.ShortHash(block.Hash()),
+		"contents", contents,
+	)
 	// broadcast the new block in parallel
 	reqBytes, err := json.Marshal(request)
 	if err != nil {
-		log.Fatalf("failed to encode broadcast request")
+		m.logger.Error("failed to encode broadcast request", "error", err)
+		return
 	}
 	wg := sync.WaitGroup{}
-	for _, peer := range peers {
-		peer := peer
+	// banned peers are left out
+	targets := m.unbannedPeers(peers)
+	results := make([]PeerResultJson, len(targets))
+	for i, peer := range targets {
+		i, peer := i, peer
 		wg.Add(1)
-		go m.broadcastTo(peer, reqBytes, &wg)
+		go func() {
+			defer wg.Done()
+			results[i] = newPeerResult(peer, m.broadcastTo(peer, reqBytes))
+		}()
 	}
 	wg.Wait()
+	m.statsLock.Lock()
+	m.lastBroadcast = results
+	m.statsLock.Unlock()
 }
 
-// broadcastTo - broadcast a newly mined block to one peer
-func (m *Miner) broadcastTo(peer int, data []byte, wg *sync.WaitGroup) {
-	defer wg.Done()
-	url := fmt.Sprintf("http://localhost:%d/broadcast", peer)
-	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+// fetchBlocks - reads the blocks of heights from to to-1 from the /read API of the miner listening on port, at most
+// FetchPageSize blocks at a time. Each page is validated as it arrives, apart from the timestamps of its blocks, which
+// need the blocks below it, so that reading stops at the first invalid page; the error is then a
+// *blockchain.ValidationError. A port of 0 is not bound to the node that asks for the blocks, so nothing is read from it.
+func (m *Miner) fetchBlocks(port int, from int, to int) ([]blockchain.Block, error) {
+	blocks := make([]blockchain.Block, 0)
+	if from < to && port == 0 {
+		return nil, errors.New("port of the peer is not bound to its node ID")
+	}
+	for height := from; height < to; {
+		page, err := m.fetchPage(port, height, to)
+		if err != nil {
+			return nil, err
+		}
+		if page.Start != height || len(page.Blockchain) == 0 || len(page.Blockchain) > to-height {
+			return nil, fmt.Errorf("peer returned a wrong page of blocks from height %d", height)
+		}
+		if page.Pruned > height {
+			return nil, fmt.Errorf("peer has pruned the posts of the blocks below height %d", page.Pruned)
+		}
+		decoded := make([]blockchain.Block, 0, len(page.Blockchain))
+		for _, encoded := range page.Blockchain {
+			block, err := encoded.DecodeBase64()
+			if err != nil {
+				return nil, err
+			}
+			decoded = append(decoded, block)
+		}
+		if len(blocks) > 0 && !bytes.Equal(decoded[0].Header.PrevHash, blocks[len(blocks)-1].Hash()) {
+			return nil, &blockchain.ValidationError{Rule: blockchain.RuleLinkage, Height: height, Post: -1}
+		}
+		err = blockchain.ValidateChain(decoded, blockchain.ValidateOptions{Network: &m.network, Start: height, Cache: m.verified})
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, decoded...)
+		height += len(decoded)
+	}
+	return blocks, nil
+}
+
+// fetchPage - reads a page of the blocks from height from on, and below to, from the miner listening on port.
+func (m *Miner) fetchPage(port int, from int, to int) (ReadJson, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	path := fmt.Sprintf("/read?from=%d&to=%d&limit=%d", from, to, FetchPageSize)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.tls.URL(port, path), nil)
 	if err != nil {
-		log.Printf("error when broadcasting to peer %d: %s\n", peer, err.Error())
-		return
+		return ReadJson{}, err
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return ReadJson{}, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("failed to broadcast to peer %d\n", peer)
+		return ReadJson{}, fmt.Errorf("peer responded with status code %d", resp.StatusCode)
+	}
+	var page ReadJson
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxPeerRequestSize)).Decode(&page); err != nil {
+		return ReadJson{}, err
+	}
+	return page, nil
+}
+
+// broadcastTo - broadcast a newly mined block to one peer
+func (m *Miner) broadcastTo(peer int, data []byte) error {
+	m.metrics.broadcastsSent.Inc()
+	resp, err := m.postToPeer(peer, "/broadcast", data)
+	if err != nil {
+		m.logger.Warn("error when broadcasting to peer", "peer", peer, "error", err)
+		m.metrics.broadcastsFailed.Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	var result BroadcastResultJson
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		m.logger.Warn("failed to decode broadcast result", "peer", peer, "status", resp.StatusCode, "error", err)
+		m.metrics.broadcastsFailed.Inc()
+		return fmt.Errorf("peer responded with status code %d", resp.StatusCode)
+	}
+	m.metrics.broadcastResults.With(result.Result, result.Reason).Inc()
+	switch result.Result {
+	case BroadcastAccepted:
+		m.logger.Debug("peer accepted broadcast", "peer", peer)
+	case BroadcastIgnored:
+		m.logger.Debug("peer ignored broadcast", "peer", peer, "reason", result.Reason)
+	default:
+		m.logger.Warn("peer rejected broadcast", "peer", peer, "reason", result.Reason, "index", result.Index)
+		m.metrics.broadcastsFailed.Inc()
+		return fmt.Errorf("peer rejected blockchain: %s at block %d", result.Reason, result.Index)
+	}
+	return nil
+}
+
+// dropStalePosts - removes the posts from the pool that have become too old to be included in a new block.
+// Must be called with m.lock held.
+func (m *Miner) dropStalePosts() {
+	now := time.Now().UnixNano()
+	stale := make([]interface{}, 0)
+	iter := m.pool.Iterator()
+	for iter.Next() {
+		post := iter.Value().(blockchain.Post)
+		if post.Body.Timestamp < now-int64(blockchain.PostTimeWindow) {
+			stale = append(stale, post)
+		}
+	}
+	if len(stale) > 0 {
+		m.pool.Remove(stale...)
+		m.logger.Info("dropped stale posts from the pool", "count", len(stale))
 	}
 }
@@ -0,0 +1,100 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"bytes"
+	"errors"
+	"github.com/emirpasic/gods/sets/treeset"
+	"net/http"
+	"time"
+)
+
+// prune - replaces blocks older than the latest m.pruning blocks with their headers, if the miner prunes.
+// The stubs of their posts stay in m.posts. m.lock must be held for writing.
+func (m *Miner) prune() {
+	if m.pruning == 0 {
+		return
+	}
+	for ; m.pruned < len(m.blockChain)-m.pruning; m.pruned++ {
+		m.blockChain[m.pruned] = m.blockChain[m.pruned].Prune()
+	}
+}
+
+// snapshotHandler - handles GET /admin/snapshot request
+// returns the headers of the blocks below the requested height and the stubs of their posts, which a new miner loads
+// with POST /admin/snapshot. Blocks from the height onwards must not be pruned, since their posts are left out.
+func (m *Miner) snapshotHandler(query SnapshotQuery) (int, any) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	height := query.Height
+	if height == 0 {
+		// by default, the snapshot holds the blocks that are final
+		height = max(m.pruned, len(m.blockChain)-m.finality, 0)
+	}
+	if height < m.pruned || height > len(m.blockChain) {
+		return http.StatusBadRequest, map[string]string{"error": "height is out of range"}
+	}
+	snapshot := blockchain.Snapshot{Headers: make([]blockchain.BlockHeader, 0, height)}
+	for _, block := range m.blockChain[:height] {
+		snapshot.Headers = append(snapshot.Headers, block.Header)
+	}
+	later := treeset.NewWith(m.cmp)
+	for _, block := range m.blockChain[height:] {
+		for _, post := range block.Posts {
+			later.Add(post)
+		}
+	}
+	iter := m.posts.Iterator()
+	for iter.Next() {
+		post := iter.Value().(blockchain.Post)
+		if !later.Contains(post) {
+			snapshot.Posts = append(snapshot.Posts, post)
+		}
+	}
+	return http.StatusOK, snapshot.EncodeBase64()
+}
+
+// bootstrapHandler - handles POST /admin/snapshot request, which carries a snapshot from a trusted miner
+// a miner whose blockchain is shorter than the snapshot switches to its pruned blocks, and receives the posts of the
+// blocks after them with the next broadcast. The snapshot is never held against anyone.
+func (m *Miner) bootstrapHandler(snapshot blockchain.Snapshot) (int, any) {
+	err := snapshot.Verify(blockchain.ValidateOptions{Network: &m.network, Now: time.Now()})
+	var invalid *blockchain.ValidationError
+	if errors.As(err, &invalid) {
+		m.logger.Warn("refused to load a snapshot", "reason", invalid.Rule, "index", invalid.Height, "error", err)
+		return http.StatusBadRequest, BroadcastResultJson{
+			Result: BroadcastInvalid,
+			Reason: string(invalid.Rule),
+			Index:  invalid.Height,
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if snapshot.Height() <= len(m.blockChain) {
+		return http.StatusOK, BroadcastResultJson{Result: BroadcastIgnored, Reason: "not-longer", Index: -1}
+	}
+	chain := snapshot.Blocks()
+	for i := range chain {
+		chain[i].Hash() // memoised before other goroutines can read the blocks
+	}
+	fork := 0
+	for ; fork < len(m.blockChain); fork++ {
+		if !bytes.Equal(m.blockChain[fork].Hash(), chain[fork].Hash()) {
+			break
+		}
+	}
+	if len(m.blockChain)-fork > m.finality || fork < m.pruned {
+		m.logger.Warn("refused to load a snapshot", "reason", "finality", "index", fork)
+		return http.StatusBadRequest, BroadcastResultJson{Result: BroadcastInvalid, Reason: "finality", Index: fork}
+	}
+	posts := treeset.NewWith(m.cmp)
+	for _, post := range snapshot.Posts {
+		posts.Add(post)
+	}
+	m.pruned = len(chain)
+	m.switchTo(chain, fork, posts)
+	m.logger.Info("loaded a snapshot", "height", len(chain), "posts", len(snapshot.Posts), "fork", fork)
+	return http.StatusOK, BroadcastResultJson{Result: BroadcastAccepted, Index: -1}
+}
@@ -0,0 +1,74 @@
+package miner
+
+import (
+	"blockchain/blockchain"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"time"
+)
+
+// PeerResultJson - the outcome of sending a request to one peer.
+type PeerResultJson struct {
+	Peer  int    `json:"peer"`            // peer's http port
+	Time  int64  `json:"time"`            // unix time in milliseconds when the request finished
+	Error string `json:"error,omitempty"` // empty if the request succeeded
+}
+
+// StatusJson - response of /status.
+type StatusJson struct {
+	Port           int              `json:"port"`
+	NodeID         string           `json:"node-id"` // hex-encoded public node key signing requests to peers
+	Network        string           `json:"network"` // ID of the network the miner belongs to
+	Version        string           `json:"version"`
+	Uptime         int64            `json:"uptime"`          // milliseconds since the miner started
+	Height         int              `json:"height"`          // length of the blockchain
+	Pruned         int              `json:"pruned"`          // height below which blocks hold their headers only
+	TipHash        string           `json:"tip-hash"`        // base64-encoded identity hash of the last block
+	CumulativeWork uint64           `json:"cumulative-work"` // expected number of hashes to mine the blockchain
+	PoolSize       int              `json:"pool-size"`
+	Peers          []int            `json:"peers"`          // peers from the last registration, or from the address book
+	Addresses      []int            `json:"addresses"`      // miners in the address book
+	HashRate       float64          `json:"hash-rate"`      // hashes per second of the last mining round
+	LastSync       []PeerResultJson `json:"last-sync"`      // results of the last round of syncing the pool
+	LastBroadcast  []PeerResultJson `json:"last-broadcast"` // results of the last broadcast of a mined block
+}
+
+// newPeerResult - records the outcome of a request to a peer.
+func newPeerResult(peer int, err error) PeerResultJson {
+	result := PeerResultJson{Peer: peer, Time: time.Now().UnixMilli()}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// statusHandler - handles /status request
+// reports what the miner is currently doing
+func (m *Miner) statusHandler() (int, any) {
+	m.lock.RLock()
+	resp := StatusJson{
+		Port:           m.port,
+		NodeID:         NodeID(m.nodeKey.Public().(ed25519.PublicKey)),
+		Network:        m.networkID,
+		Version:        blockchain.Version,
+		Uptime:         time.Since(m.started).Milliseconds(),
+		Height:         len(m.blockChain),
+		Pruned:         m.pruned,
+		CumulativeWork: uint64(len(m.blockChain)) << blockchain.TARGET,
+		PoolSize:       m.pool.Size(),
+		Peers:          append(make([]int, 0), m.peers...),
+		Addresses:      m.book.list(),
+	}
+	if len(m.blockChain) > 0 {
+		resp.TipHash = base64.StdEncoding.EncodeToString(m.blockChain[len(m.blockChain)-1].Hash())
+	}
+	m.lock.RUnlock()
+
+	m.statsLock.Lock()
+	resp.HashRate = m.hashRate
+	resp.LastSync = append(make([]PeerResultJson, 0), m.lastSync...)
+	resp.LastBroadcast = append(make([]PeerResultJson, 0), m.lastBroadcast...)
+	m.statsLock.Unlock()
+	return http.StatusOK, resp
+}
@@ -5,14 +5,18 @@ import (
 	"blockchain/miner"
 	"blockchain/tracker"
 	Tracker "blockchain/tracker"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -193,6 +197,67 @@ func WriteBlockchain(port int, content string) error {
 	return nil
 }
 
+// WaitForStatus polls the /status endpoint of the node listening on port until it serves a status that ready accepts,
+// or gives up after about two seconds.
+func WaitForStatus[T any](port int, ready func(status T) bool) error {
+	for i := 0; i < 200; i++ {
+		if resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", port)); err == nil {
+			var status T
+			err = json.NewDecoder(resp.Body).Decode(&status)
+			resp.Body.Close()
+			if err == nil && resp.StatusCode == http.StatusOK && ready(status) {
+				return nil
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("node %d is not ready", port)
+}
+
+// ScrapeMetrics reads a node's /metrics endpoint and parses each sample into a map from the sample name, including
+// its labels, to its value.
+func ScrapeMetrics(port int) (map[string]float64, error) {
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/metrics", port))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample %q: %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples, scanner.Err()
+}
+
+// MineBlock searches for a nonce that makes the block's header meet blockchain.TARGET.
+func MineBlock(block *blockchain.Block) {
+	for !block.Header.Verify() {
+		block.Header.Nonce++
+	}
+}
+
+// PostAsPeer sends a json request to a miner's peer API, signed with key on behalf of a miner listening on from in
+// blockchain.MainNetwork.
+func PostAsPeer(port int, path string, key ed25519.PrivateKey, from int, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("http://localhost:%d%s", port, path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	miner.SignRequest(req, key, from, blockchain.MainNetwork.ID(), body)
+	return http.DefaultClient.Do(req)
+}
+
 // N defines the number of miners to select for writing posts.
 const (
 	N = 3
@@ -6,9 +6,21 @@ import (
 	Tracker "blockchain/tracker"
 	User "blockchain/user"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -24,6 +36,13 @@ func TestMaliciousUser(t *testing.T) {
 	legitimateMiner := Miner.NewMiner(3003, 8082)
 	legitimateMiner.Start()
 	defer legitimateMiner.Shutdown()
+	// the user writes to the miners registered with the tracker, so wait until the miner is serving and registered
+	if err := WaitForStatus(3003, func(Miner.StatusJson) bool { return true }); err != nil {
+		t.Fatalf("miner does not start: %v", err)
+	}
+	if err := WaitForStatus(8082, func(status Tracker.StatusJson) bool { return status.Miners > 0 }); err != nil {
+		t.Fatalf("miner does not register: %v", err)
+	}
 
 	// Create a malicious user
 	maliciousUser := User.NewUser(8082)
@@ -121,6 +140,18 @@ func TestMaliciousMiner(t *testing.T) {
 	// wait for a block to be mined
 	time.Sleep(20000 * time.Millisecond)
 
+	// the attacks are signed by a node, so that they reach the handlers rather than being refused as unsigned
+	_, nodeKey, _ := ed25519.GenerateKey(rand.Reader)
+	attack := func(path string, body []byte, response any) int {
+		resp, err := PostAsPeer(3000, path, nodeKey, 4000, body)
+		if err != nil {
+			t.Fatalf("error when attacking %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+		_ = json.NewDecoder(resp.Body).Decode(response)
+		return resp.StatusCode
+	}
+
 	// tries to attack miner's /sync API with a fake post
 	fakePost, _ := postBase64.DecodeBase64()
 	fakePost.Body.Content = "Malicious content"
@@ -128,19 +159,42 @@ func TestMaliciousMiner(t *testing.T) {
 	syncReq := Miner.PostsJson{}
 	syncReq.Posts = append(syncReq.Posts, fakePostBase64)
 	fakePostJson, _ := json.Marshal(syncReq)
-	resp, _ = http.Post("http://localhost:3000/sync", "application/json", bytes.NewReader(fakePostJson))
-	resp.Body.Close()
+	var syncResult map[string]string
+	if statusCode := attack("/sync", fakePostJson, &syncResult); statusCode != http.StatusBadRequest ||
+		syncResult["error"] != "posts are invalid" {
+		t.Fatalf("fake post is not rejected: %d %v", statusCode, syncResult)
+	}
 
-	// tries to attack miner's /sync API with a replayed post
-	resp, _ = http.Post("http://localhost:3000/sync", "application/json", bytes.NewReader(postJSON))
-	resp.Body.Close()
+	// tries to attack miner's /sync API with a replayed post, which is dropped since it is on the blockchain already
+	replayReq := Miner.PostsJson{Posts: []blockchain.PostBase64{postBase64}}
+	replayJson, _ := json.Marshal(replayReq)
+	if statusCode := attack("/sync", replayJson, &syncResult); statusCode != http.StatusOK {
+		t.Fatalf("replayed post is not dropped: %d %v", statusCode, syncResult)
+	}
 
-	// tries to attack miner's /broadcast API with a very long, fake blockchain
+	// tries to attack miner's /broadcast API with a very long, fake blockchain, which extends the miner's blockchain so
+	// that it is validated rather than refused as a deep reorg
+	tip := ReadBlockchain(3000)
+	if len(tip) == 0 {
+		t.Fatalf("failed to retrieve from miner 3000")
+	}
+	fakeBlock := blockchain.Block{Header: blockchain.BlockHeader{
+		PrevHash:  tip[len(tip)-1].Hash(),
+		Summary:   blockchain.MerkleRoot([]blockchain.Post{}),
+		Timestamp: time.Now().UnixNano(),
+	}}
 	fakeBlockchain := make([]blockchain.BlockBase64, 100)
-	fakeBroadcastReq := Miner.BlockChainJson{Blockchain: fakeBlockchain}
+	for i := range fakeBlockchain {
+		fakeBlockchain[i] = fakeBlock.EncodeBase64()
+	}
+	fakeBroadcastReq := Miner.BlockChainJson{Start: len(tip), Blockchain: fakeBlockchain}
 	fakeBroadcastJson, _ := json.Marshal(fakeBroadcastReq)
-	resp, _ = http.Post("http://localhost:3000/broadcast", "application/json", bytes.NewReader(fakeBroadcastJson))
-	resp.Body.Close()
+	var broadcastResult Miner.BroadcastResultJson
+	if statusCode := attack("/broadcast", fakeBroadcastJson, &broadcastResult); statusCode != http.StatusBadRequest ||
+		broadcastResult.Result != Miner.BroadcastInvalid || broadcastResult.Reason != "proof-of-work" ||
+		broadcastResult.Index != len(tip) {
+		t.Fatalf("fake blockchain is not rejected: %d %+v", statusCode, broadcastResult)
+	}
 
 	time.Sleep(10000 * time.Millisecond)
 	user := User.NewUser(8080)
@@ -160,3 +214,1213 @@ func TestMaliciousMiner(t *testing.T) {
 	miner.Shutdown()
 	tracker.Shutdown()
 }
+
+// TestStatus - tests that a miner and a tracker report their state on /status
+func TestStatus(t *testing.T) {
+	tracker := Tracker.NewTracker(8086)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3012, 8086)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(2000 * time.Millisecond)
+
+	resp, err := http.Get("http://localhost:3012/status")
+	if err != nil {
+		t.Fatalf("error when reading miner status: %v", err)
+	}
+	var minerStatus Miner.StatusJson
+	_ = json.NewDecoder(resp.Body).Decode(&minerStatus)
+	resp.Body.Close()
+	if minerStatus.Port != 3012 || minerStatus.Version != blockchain.Version {
+		t.Fatalf("miner reports wrong identity: %+v", minerStatus)
+	}
+	if minerStatus.HashRate <= 0 || minerStatus.Uptime <= 0 {
+		t.Fatalf("miner does not report that it is mining: %+v", minerStatus)
+	}
+	if len(minerStatus.Peers) != 0 {
+		t.Fatalf("miner reports peers that do not exist: %v", minerStatus.Peers)
+	}
+
+	resp, err = http.Get("http://localhost:8086/status")
+	if err != nil {
+		t.Fatalf("error when reading tracker status: %v", err)
+	}
+	var trackerStatus Tracker.StatusJson
+	_ = json.NewDecoder(resp.Body).Decode(&trackerStatus)
+	resp.Body.Close()
+	if trackerStatus.Miners != 1 || trackerStatus.Requests["register"] == 0 {
+		t.Fatalf("tracker reports wrong registrations: %+v", trackerStatus)
+	}
+}
+
+// TestMetrics - tests that a miner and a tracker expose their metrics on /metrics in Prometheus text format
+func TestMetrics(t *testing.T) {
+	tracker := Tracker.NewTracker(8087)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3013, 8087)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(2000 * time.Millisecond)
+
+	samples, err := ScrapeMetrics(3013)
+	if err != nil {
+		t.Fatalf("error when scraping miner: %v", err)
+	}
+	if samples["miner_hashes_total"] <= 0 {
+		t.Fatalf("miner does not count hashes")
+	}
+	if _, ok := samples[`miner_reorg_depth_bucket{le="+Inf"}`]; !ok {
+		t.Fatalf("miner does not expose the reorg depth histogram")
+	}
+	if _, ok := samples["miner_pool_size"]; !ok {
+		t.Fatalf("miner does not expose its pool size")
+	}
+
+	samples, err = ScrapeMetrics(8087)
+	if err != nil {
+		t.Fatalf("error when scraping tracker: %v", err)
+	}
+	if samples["tracker_active_miners"] != 1 || samples["tracker_registrations_total"] != 1 {
+		t.Fatalf("tracker reports wrong registrations: %v", samples)
+	}
+}
+
+// lockedBuffer - a bytes.Buffer that can be written by a logger and read by a test concurrently.
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+// TestStructuredLogging - tests that a miner sends structured records carrying its port to the configured logger
+func TestStructuredLogging(t *testing.T) {
+	var buffer lockedBuffer
+	logger := slog.New(slog.NewJSONHandler(&buffer, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	miner := Miner.NewMiner(3014, 8088, Miner.WithLogger(logger))
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	resp, err := http.Get("http://localhost:3014/status")
+	if err != nil {
+		t.Fatalf("error when reading miner status: %v", err)
+	}
+	resp.Body.Close()
+	found := false
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		var record map[string]any
+		if json.Unmarshal([]byte(line), &record) != nil {
+			continue
+		}
+		if record["msg"] == "handled request" && record["path"] == "/status" {
+			if record["port"] != float64(3014) || record["node"] != "miner" {
+				t.Fatalf("request log does not carry the miner's context: %s", line)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("request is not logged")
+	}
+}
+
+// TestBroadcastResults - tests that /broadcast tells the sender whether its blockchain is accepted, ignored or invalid
+func TestBroadcastResults(t *testing.T) {
+	miner := Miner.NewMiner(3015, 8089)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	broadcast := func(body []byte) (int, Miner.BroadcastResultJson) {
+		resp, err := PostAsPeer(3015, "/broadcast", key, 4000, body)
+		if err != nil {
+			t.Fatalf("error when broadcasting: %v", err)
+		}
+		defer resp.Body.Close()
+		var result Miner.BroadcastResultJson
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	// an empty blockchain is never longer
+	request, _ := json.Marshal(Miner.BlockChainJson{})
+	statusCode, result := broadcast(request)
+	if statusCode != http.StatusOK || result.Result != Miner.BroadcastIgnored || result.Reason != "not-longer" {
+		t.Fatalf("empty blockchain is not ignored: %d %+v", statusCode, result)
+	}
+
+	// a request that is not json
+	statusCode, result = broadcast([]byte("not json"))
+	if statusCode != http.StatusBadRequest || result.Result != Miner.BroadcastInvalid || result.Reason != "format" {
+		t.Fatalf("malformed request is not rejected: %d %+v", statusCode, result)
+	}
+
+	// a block that is not mined; it is checked last, since it gets the sender banned
+	block := blockchain.Block{Header: blockchain.BlockHeader{PrevHash: make([]byte, 32), Summary: blockchain.MerkleRoot([]blockchain.Post{})}}
+
+	// blocks above the miner's blockchain need the earlier ones, which a sender whose port is not bound cannot serve
+	request, _ = json.Marshal(Miner.BlockChainJson{Start: Miner.MaxBroadcastGap, Blockchain: []blockchain.BlockBase64{block.EncodeBase64()}})
+	statusCode, result = broadcast(request)
+	if statusCode != http.StatusOK || result.Result != Miner.BroadcastIgnored || result.Reason != "unavailable" {
+		t.Fatalf("unlinked blocks are not ignored: %d %+v", statusCode, result)
+	}
+	// and blocks far above it are refused without reading any, but without penalizing the sender either
+	request, _ = json.Marshal(Miner.BlockChainJson{Start: 1000000000, Blockchain: []blockchain.BlockBase64{block.EncodeBase64()}})
+	statusCode, result = broadcast(request)
+	if statusCode != http.StatusBadRequest || result.Result != Miner.BroadcastInvalid || result.Reason != "gap" {
+		t.Fatalf("blocks far above the blockchain are not refused: %d %+v", statusCode, result)
+	}
+	request, _ = json.Marshal(Miner.BlockChainJson{Start: -1, Blockchain: []blockchain.BlockBase64{block.EncodeBase64()}})
+	statusCode, result = broadcast(request)
+	if statusCode != http.StatusBadRequest || result.Result != Miner.BroadcastInvalid || result.Reason != "format" {
+		t.Fatalf("negative start is not rejected: %d %+v", statusCode, result)
+	}
+	fake := Miner.BlockChainJson{}
+	for i := 0; i < 100; i++ {
+		fake.Blockchain = append(fake.Blockchain, block.EncodeBase64())
+	}
+	request, _ = json.Marshal(fake)
+	statusCode, result = broadcast(request)
+	if statusCode != http.StatusBadRequest || result.Result != Miner.BroadcastInvalid || result.Reason != "proof-of-work" || result.Index != 0 {
+		t.Fatalf("unmined blockchain is not rejected: %d %+v", statusCode, result)
+	}
+
+	samples, _ := ScrapeMetrics(3015)
+	if samples[`miner_blocks_rejected_total{reason="proof-of-work"}`] != 1 {
+		t.Fatalf("rejection is not counted")
+	}
+	// ignored broadcasts are counted apart from invalid ones
+	if samples[`miner_broadcasts_ignored_total{reason="not-longer"}`] != 1 ||
+		samples[`miner_blocks_rejected_total{reason="not-longer"}`] != 0 {
+		t.Fatalf("ignored broadcast is not counted apart from rejections")
+	}
+}
+
+// TestBroadcastWindow - tests that a miner reads the blocks that come before a broadcast from the sender once the
+// sender's port is bound to its node ID, and adopts the whole blockchain
+func TestBroadcastWindow(t *testing.T) {
+	// mine the sender's blockchain before the miner starts, so that it is longer than the miner's own
+	chain := make([]blockchain.Block, 0)
+	for len(chain) < Miner.BroadcastBlocks+4 {
+		block := blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.MainNetwork.GenesisHash(),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{}),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Posts: []blockchain.Post{},
+		}
+		if len(chain) > 0 {
+			block.Header.PrevHash = blockchain.Hash(chain[len(chain)-1].Header)
+		}
+		MineBlock(&block)
+		chain = append(chain, block)
+	}
+
+	// the sender serves its node ID and its blocks, as a miner would
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	reads := 0
+	var lock sync.Mutex
+	sender := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			_ = json.NewEncoder(w).Encode(Miner.StatusJson{NodeID: Miner.NodeID(key.Public().(ed25519.PublicKey))})
+			return
+		}
+		lock.Lock()
+		reads++
+		lock.Unlock()
+		from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+		to, _ := strconv.Atoi(r.URL.Query().Get("to"))
+		read := Miner.ReadJson{Height: len(chain), Start: from}
+		for _, block := range chain[from:to] {
+			read.Blockchain = append(read.Blockchain, block.EncodeBase64())
+		}
+		_ = json.NewEncoder(w).Encode(read)
+	}))
+	defer sender.Close()
+	port := extractPort(sender.URL)
+
+	miner := Miner.NewMiner(3034, 8104, Miner.WithFinalityDepth(Miner.BroadcastBlocks+4))
+	miner.Start()
+	defer miner.Shutdown()
+
+	start := len(chain) - Miner.BroadcastBlocks
+	request := Miner.BlockChainJson{Start: start}
+	for _, block := range chain[start:] {
+		request.Blockchain = append(request.Blockchain, block.EncodeBase64())
+	}
+	data, _ := json.Marshal(request)
+	// the miner binds the sender's port in the background, and ignores the broadcast until then
+	var result Miner.BroadcastResultJson
+	for i := 0; i < 200; i++ {
+		resp, err := PostAsPeer(3034, "/broadcast", key, port, data)
+		if err == nil {
+			result = Miner.BroadcastResultJson{}
+			_ = json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			if result.Result != Miner.BroadcastIgnored || result.Reason != "unavailable" {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if result.Result != Miner.BroadcastAccepted {
+		t.Fatalf("broadcast is not accepted: %+v", result)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if reads == 0 {
+		t.Fatalf("earlier blocks are not read from the sender")
+	}
+	read := ReadBlockchain(3034)
+	if len(read) < len(chain) || !bytes.Equal(read[len(chain)-1].Hash(), chain[len(chain)-1].Hash()) {
+		t.Fatalf("sender's blockchain is not adopted")
+	}
+}
+
+// TestInvalidBroadcastWindow - tests that a miner validates the blocks that it reads from the sender of a broadcast as
+// they arrive, and bans a sender that serves invalid ones
+func TestInvalidBroadcastWindow(t *testing.T) {
+	chain := make([]blockchain.Block, 0)
+	for len(chain) < Miner.BroadcastBlocks+2 {
+		block := blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.MainNetwork.GenesisHash(),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{}),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Posts: []blockchain.Post{},
+		}
+		if len(chain) > 0 {
+			block.Header.PrevHash = blockchain.Hash(chain[len(chain)-1].Header)
+		}
+		MineBlock(&block)
+		chain = append(chain, block)
+	}
+	start := len(chain) - Miner.BroadcastBlocks
+	request := Miner.BlockChainJson{Start: start}
+	for _, block := range chain[start:] {
+		request.Blockchain = append(request.Blockchain, block.EncodeBase64())
+	}
+	data, _ := json.Marshal(request)
+	// the first block is served without its proof of work
+	forged := chain[0]
+	forged.Header.Nonce++
+	for forged.Header.Verify() {
+		forged.Header.Nonce++
+	}
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	sender := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			_ = json.NewEncoder(w).Encode(Miner.StatusJson{NodeID: Miner.NodeID(key.Public().(ed25519.PublicKey))})
+			return
+		}
+		from, _ := strconv.Atoi(r.URL.Query().Get("from"))
+		to, _ := strconv.Atoi(r.URL.Query().Get("to"))
+		read := Miner.ReadJson{Height: len(chain), Start: from}
+		for height := from; height < to; height++ {
+			block := chain[height]
+			if height == 0 {
+				block = forged
+			}
+			read.Blockchain = append(read.Blockchain, block.EncodeBase64())
+		}
+		_ = json.NewEncoder(w).Encode(read)
+	}))
+	defer sender.Close()
+	port := extractPort(sender.URL)
+
+	miner := Miner.NewMiner(3035, 8105, Miner.WithFinalityDepth(Miner.BroadcastBlocks+2))
+	miner.Start()
+	defer miner.Shutdown()
+
+	// the miner binds the sender's port in the background, and ignores the broadcast until then
+	var result Miner.BroadcastResultJson
+	statusCode := 0
+	for i := 0; i < 200; i++ {
+		resp, err := PostAsPeer(3035, "/broadcast", key, port, data)
+		if err == nil {
+			result = Miner.BroadcastResultJson{}
+			_ = json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			statusCode = resp.StatusCode
+			if result.Result != Miner.BroadcastIgnored || result.Reason != "unavailable" {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if statusCode != http.StatusBadRequest || result.Result != Miner.BroadcastInvalid ||
+		result.Reason != "proof-of-work" || result.Index != 0 {
+		t.Fatalf("invalid earlier blocks are not rejected: %d %+v", statusCode, result)
+	}
+	resp, err := PostAsPeer(3035, "/broadcast", key, port, data)
+	if err != nil {
+		t.Fatalf("error when broadcasting: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("sender of invalid blocks is not banned: %d", resp.StatusCode)
+	}
+}
+
+// TestPeerBanning - tests that a miner refuses unsigned and replayed peer messages, bans a node that broadcasts an
+// invalid blockchain, and that bans can be cleared
+func TestPeerBanning(t *testing.T) {
+	miner := Miner.NewMiner(3016, 8090)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	_, honest, _ := ed25519.GenerateKey(rand.Reader)
+	_, malicious, _ := ed25519.GenerateKey(rand.Reader)
+	maliciousID := Miner.NodeID(malicious.Public().(ed25519.PublicKey))
+	broadcastFrom := func(key ed25519.PrivateKey, from int, body []byte) int {
+		resp, err := PostAsPeer(3016, "/broadcast", key, from, body)
+		if err != nil {
+			t.Fatalf("error when broadcasting: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	broadcast := func(key ed25519.PrivateKey, body []byte) int {
+		return broadcastFrom(key, 4000, body)
+	}
+	block := blockchain.Block{Header: blockchain.BlockHeader{PrevHash: make([]byte, 32), Summary: blockchain.MerkleRoot([]blockchain.Post{})}}
+	// the invalid chain is long enough not to be ignored even if the miner has mined a few blocks meanwhile
+	invalidChain := make([]blockchain.BlockBase64, 10)
+	for i := range invalidChain {
+		invalidChain[i] = block.EncodeBase64()
+	}
+	invalid, _ := json.Marshal(Miner.BlockChainJson{Blockchain: invalidChain})
+	empty, _ := json.Marshal(Miner.BlockChainJson{})
+
+	// unsigned and forged messages are refused without penalizing anyone
+	resp, err := http.Post("http://localhost:3016/broadcast", "application/json", bytes.NewReader(invalid))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("unsigned message is not refused: %v", err)
+	}
+	resp.Body.Close()
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:3016/broadcast", bytes.NewReader(invalid))
+	Miner.SignRequest(req, malicious, 4000, blockchain.MainNetwork.ID(), empty)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("forged message is not refused: %v", err)
+	}
+	resp.Body.Close()
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost:3016/broadcast", bytes.NewReader(empty))
+	Miner.SignRequest(req, malicious, 4000, blockchain.MainNetwork.ID(), empty)
+	req.Header.Set(Miner.NetworkHeader, "another-network")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("message with a swapped network is not refused: %v", err)
+	}
+	resp.Body.Close()
+
+	// a signed message is served once, and cannot be replayed to the same miner or sent to another host
+	req, _ = http.NewRequest(http.MethodPost, "http://localhost:3016/broadcast", bytes.NewReader(empty))
+	Miner.SignRequest(req, honest, 4001, blockchain.MainNetwork.ID(), empty)
+	for i, expected := range []int{http.StatusOK, http.StatusUnauthorized} {
+		replay, _ := http.NewRequest(http.MethodPost, "http://localhost:3016/broadcast", bytes.NewReader(empty))
+		replay.Header = req.Header.Clone()
+		resp, err = http.DefaultClient.Do(replay)
+		if err != nil || resp.StatusCode != expected {
+			t.Fatalf("message sent %d times is not answered with %d: %v", i+1, expected, err)
+		}
+		resp.Body.Close()
+	}
+	redirected, _ := http.NewRequest(http.MethodPost, "http://127.0.0.1:3016/broadcast", bytes.NewReader(empty))
+	Miner.SignRequest(redirected, honest, 4001, blockchain.MainNetwork.ID(), empty)
+	redirected.Host = "localhost:3017"
+	resp, err = http.DefaultClient.Do(redirected)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("message signed for another host is not refused: %v", err)
+	}
+	resp.Body.Close()
+
+	// the node is banned, even though it declares the same port as an honest node
+	if statusCode := broadcast(malicious, invalid); statusCode != http.StatusBadRequest {
+		t.Fatalf("invalid blockchain is not rejected: %d", statusCode)
+	}
+	if statusCode := broadcast(malicious, empty); statusCode != http.StatusForbidden {
+		t.Fatalf("misbehaving node is not banned: %d", statusCode)
+	}
+	if statusCode := broadcast(honest, empty); statusCode != http.StatusOK {
+		t.Fatalf("well-behaved node is banned: %d", statusCode)
+	}
+
+	// the ban is listed
+	resp, err = http.Get("http://localhost:3016/admin/bans")
+	if err != nil {
+		t.Fatalf("error when listing bans: %v", err)
+	}
+	var bans []Miner.BanJson
+	_ = json.NewDecoder(resp.Body).Decode(&bans)
+	resp.Body.Close()
+	if len(bans) != 1 || bans[0].Peer != maliciousID || !bans[0].Banned || bans[0].Reason != "proof-of-work" {
+		t.Fatalf("wrong bans are listed: %+v", bans)
+	}
+
+	// clear the ban
+	req, _ = http.NewRequest(http.MethodDelete, "http://localhost:3016/admin/bans/"+maliciousID, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error when clearing the ban: %v", err)
+	}
+	resp.Body.Close()
+	if statusCode := broadcast(malicious, empty); statusCode != http.StatusOK {
+		t.Fatalf("ban is not cleared: %d", statusCode)
+	}
+
+	// a node banned on the port that it listens on cannot come back on that port with a new key
+	_, bound, _ := ed25519.GenerateKey(rand.Reader)
+	boundID := Miner.NodeID(bound.Public().(ed25519.PublicKey))
+	node := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Miner.StatusJson{NodeID: boundID})
+	}))
+	defer node.Close()
+	port := extractPort(node.URL)
+	if statusCode := broadcastFrom(bound, port, empty); statusCode != http.StatusOK {
+		t.Fatalf("well-behaved node is refused: %d", statusCode)
+	}
+	if statusCode := broadcastFrom(bound, port, invalid); statusCode != http.StatusBadRequest {
+		t.Fatalf("invalid blockchain is not rejected: %d", statusCode)
+	}
+	// the miner confirms the node ID on /status in the background, and bans the port once it is confirmed
+	for i := 0; i < 200; i++ {
+		resp, err = http.Get("http://localhost:3016/admin/bans")
+		if err != nil {
+			t.Fatalf("error when listing bans: %v", err)
+		}
+		bans = nil
+		_ = json.NewDecoder(resp.Body).Decode(&bans)
+		resp.Body.Close()
+		if len(bans) == 1 && len(bans[0].Ports) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(bans) != 1 || bans[0].Peer != boundID || len(bans[0].Ports) != 1 || bans[0].Ports[0] != port {
+		t.Fatalf("banned port is not listed: %+v", bans)
+	}
+	_, renewed, _ := ed25519.GenerateKey(rand.Reader)
+	if statusCode := broadcastFrom(renewed, port, empty); statusCode != http.StatusForbidden {
+		t.Fatalf("banned node comes back with a new key: %d", statusCode)
+	}
+
+	// a signed body over the size limit is refused without banning its sender, but repeated ones ban it
+	oversized := make([]byte, Miner.MaxPeerRequestSize+1)
+	if statusCode := broadcast(malicious, oversized); statusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body is not refused: %d", statusCode)
+	}
+	if statusCode := broadcast(malicious, empty); statusCode != http.StatusOK {
+		t.Fatalf("node sending a single oversized body is banned: %d", statusCode)
+	}
+	for i := 0; i < 2; i++ {
+		if statusCode := broadcast(malicious, oversized); statusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("oversized body is not refused: %d", statusCode)
+		}
+	}
+	if statusCode := broadcast(malicious, empty); statusCode != http.StatusForbidden {
+		t.Fatalf("node sending oversized bodies is not banned: %d", statusCode)
+	}
+}
+
+// TestPeerExchange - tests that miners keep syncing with the peers in their address books when the tracker is down,
+// that address books survive restarts, and that addresses are exchanged over /peers
+func TestPeerExchange(t *testing.T) {
+	dir := t.TempDir()
+	status := func(port int) Miner.StatusJson {
+		var status Miner.StatusJson
+		resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", port))
+		if err != nil {
+			t.Fatalf("error when reading miner status: %v", err)
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&status)
+		resp.Body.Close()
+		return status
+	}
+	tracker := Tracker.NewTracker(8092)
+	tracker.Start()
+	time.Sleep(500 * time.Millisecond)
+	miner1 := Miner.NewMiner(3018, 8092, Miner.WithAddressBook(dir+"/3018.json"))
+	miner1.Start()
+	miner2 := Miner.NewMiner(3019, 8092, Miner.WithAddressBook(dir+"/3019.json"))
+	miner2.Start()
+	defer miner2.Shutdown()
+	time.Sleep(1500 * time.Millisecond)
+
+	// the tracker goes down, but posts are still synced between miners
+	tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	if peers := status(3018).Peers; len(peers) != 1 || peers[0] != 3019 {
+		t.Fatalf("miner forgets its peers without the tracker: %v", peers)
+	}
+	if err := WriteBlockchain(3018, "Gossiped content"); err != nil {
+		t.Fatalf("error when posting: %v", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	posts := status(3019).PoolSize
+	for _, block := range ReadBlockchain(3019) {
+		posts += len(block.Posts)
+	}
+	if posts != 1 {
+		t.Fatalf("post is not synced without the tracker")
+	}
+
+	// the address book is restored after a restart
+	miner1.Shutdown()
+	miner1 = Miner.NewMiner(3018, 8092, Miner.WithAddressBook(dir+"/3018.json"))
+	miner1.Start()
+	defer miner1.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	if peers := status(3018).Peers; len(peers) != 1 || peers[0] != 3019 {
+		t.Fatalf("address book is not restored: %v", peers)
+	}
+
+	// addresses are exchanged with signed requests
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	request, _ := json.Marshal(Tracker.PortsJson{Ports: []int{4001}})
+	resp, err := PostAsPeer(3019, "/peers", key, 4000, request)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error when exchanging peers: %v", err)
+	}
+	var response Tracker.PortsJson
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if !reflect.DeepEqual(response.Ports, []int{3018}) {
+		t.Fatalf("wrong addresses are shared: %v", response.Ports)
+	}
+	// the sender's own port is only learnt once a miner there confirms the node ID, and nothing listens on 4000
+	if addresses := status(3019).Addresses; !reflect.DeepEqual(addresses, []int{3018, 4001}) {
+		t.Fatalf("exchanged addresses are not learnt: %v", addresses)
+	}
+}
+
+// TestPostRelay - tests that posts are announced by ID and only sent to peers that ask for them
+func TestPostRelay(t *testing.T) {
+	tracker := Tracker.NewTracker(8093)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+	miner1 := Miner.NewMiner(3020, 8093)
+	miner1.Start()
+	defer miner1.Shutdown()
+	miner2 := Miner.NewMiner(3021, 8093)
+	miner2.Start()
+	defer miner2.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	privateKey := blockchain.GenerateKey()
+	post := blockchain.Post{
+		User: &privateKey.PublicKey,
+		Body: blockchain.PostBody{Content: "Relayed content", Timestamp: time.Now().UnixNano()},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	postJSON, _ := json.Marshal(post.EncodeBase64())
+	resp, err := http.Post("http://localhost:3020/write", "application/json", bytes.NewReader(postJSON))
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error when posting: %v", err)
+	}
+	resp.Body.Close()
+	// a node that sends a post claiming the other miner's port does not stop the post from being relayed to it
+	_, impostor, _ := ed25519.GenerateKey(rand.Reader)
+	claimed := blockchain.Post{
+		User: &privateKey.PublicKey,
+		Body: blockchain.PostBody{Content: "Claimed content", Timestamp: time.Now().UnixNano()},
+	}
+	claimed.Signature = blockchain.Sign(privateKey, claimed.Body)
+	sync, _ := json.Marshal(Miner.PostsJson{Posts: []blockchain.PostBase64{claimed.EncodeBase64()}})
+	resp, err = PostAsPeer(3020, "/sync", impostor, 3021, sync)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error when syncing posts: %v", err)
+	}
+	resp.Body.Close()
+	// several rounds of relaying pass
+	time.Sleep(3000 * time.Millisecond)
+
+	// the posts reach the other miner, relayed at most once each unless they were mined first, and are not sent back
+	samples1, _ := ScrapeMetrics(3020)
+	samples2, _ := ScrapeMetrics(3021)
+	if samples1["miner_posts_relayed_total"] > 2 || samples2["miner_posts_relayed_total"] != 0 {
+		t.Fatalf("post is relayed more than once: %v %v",
+			samples1["miner_posts_relayed_total"], samples2["miner_posts_relayed_total"])
+	}
+	var status Miner.StatusJson
+	if resp, err = http.Get("http://localhost:3021/status"); err != nil {
+		t.Fatalf("error when reading miner status: %v", err)
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	received := status.PoolSize
+	for _, block := range ReadBlockchain(3021) {
+		received += len(block.Posts)
+	}
+	if received != 2 {
+		t.Fatalf("posts do not reach the other miner: %d", received)
+	}
+
+	// a peer that announces a post already seen is not asked for it
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	id := base64.StdEncoding.EncodeToString(post.ID())
+	request, _ := json.Marshal(Miner.InventoryJson{IDs: []string{id, base64.StdEncoding.EncodeToString(make([]byte, 32))}})
+	resp, err = PostAsPeer(3021, "/inv", key, 4000, request)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("error when announcing posts: %v", err)
+	}
+	var response Miner.InventoryJson
+	_ = json.NewDecoder(resp.Body).Decode(&response)
+	resp.Body.Close()
+	if len(response.IDs) != 1 || response.IDs[0] == id {
+		t.Fatalf("wrong posts are requested: %v", response.IDs)
+	}
+}
+
+// TestRequestLimits - tests that a miner refuses posts with too much content and request bodies that are too large
+func TestRequestLimits(t *testing.T) {
+	miner := Miner.NewMiner(3022, 8094)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	privateKey := blockchain.GenerateKey()
+	post := blockchain.Post{
+		User: &privateKey.PublicKey,
+		Body: blockchain.PostBody{Content: strings.Repeat("a", blockchain.MaxContentSize+1), Timestamp: time.Now().UnixNano()},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	postJSON, _ := json.Marshal(post.EncodeBase64())
+	resp, err := http.Post("http://localhost:3022/write", "application/json", bytes.NewReader(postJSON))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("post with too much content is not rejected: %v", err)
+	}
+	resp.Body.Close()
+
+	body := bytes.Repeat([]byte(" "), Miner.MaxWriteRequestSize+1)
+	resp, err = http.Post("http://localhost:3022/write", "application/json", bytes.NewReader(body))
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("request that is too large is not rejected: %v", err)
+	}
+	resp.Body.Close()
+
+	user := User.NewUser(8094)
+	if err := user.WritePost(strings.Repeat("a", blockchain.MaxContentSize+1)); err == nil {
+		t.Fatalf("user sends a post with too much content")
+	}
+}
+
+// TestTimestampValidation - tests that a miner refuses backdated posts, and blocks dated far in the future without
+// banning their sender, since its clock may just be ahead
+func TestTimestampValidation(t *testing.T) {
+	miner := Miner.NewMiner(3023, 8095)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	privateKey := blockchain.GenerateKey()
+	post := blockchain.Post{
+		User: &privateKey.PublicKey,
+		Body: blockchain.PostBody{Content: "Backdated", Timestamp: time.Now().Add(-2 * blockchain.PostTimeWindow).UnixNano()},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	postJSON, _ := json.Marshal(post.EncodeBase64())
+	resp, err := http.Post("http://localhost:3023/write", "application/json", bytes.NewReader(postJSON))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("backdated post is not rejected: %v", err)
+	}
+	resp.Body.Close()
+
+	block := blockchain.Block{
+		Header: blockchain.BlockHeader{
+			PrevHash:  blockchain.MainNetwork.GenesisHash(),
+			Summary:   blockchain.MerkleRoot([]blockchain.Post{}),
+			Timestamp: time.Now().Add(blockchain.MaxFutureDrift + time.Hour).UnixNano(),
+		},
+		Posts: []blockchain.Post{},
+	}
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	// the sender is never banned, so every broadcast is judged
+	rejected := 0
+	for i := 0; i < 10 && rejected < 3; i++ {
+		// extend the miner's own blockchain, so that the broadcast is longer unless the miner mines meanwhile
+		chain := ReadBlockchain(3023)
+		if len(chain) > 0 {
+			block.Header.PrevHash = blockchain.Hash(chain[len(chain)-1].Header)
+		}
+		MineBlock(&block)
+		request := Miner.BlockChainJson{}
+		for _, block := range append(chain, block) {
+			request.Blockchain = append(request.Blockchain, block.EncodeBase64())
+		}
+		data, _ := json.Marshal(request)
+		resp, err = PostAsPeer(3023, "/broadcast", key, 4001, data)
+		if err != nil {
+			t.Fatalf("error when broadcasting: %v", err)
+		}
+		var result Miner.BroadcastResultJson
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if result.Reason == "not-longer" {
+			continue
+		}
+		if resp.StatusCode != http.StatusBadRequest || result.Reason != "future" {
+			t.Fatalf("block dated in the future is not rejected: %d %v", resp.StatusCode, result)
+		}
+		rejected++
+	}
+	if rejected < 3 {
+		t.Fatalf("block dated in the future is rejected %d times", rejected)
+	}
+}
+
+// TestFinality - tests that a miner refuses broadcasts that would discard more blocks than its finality depth, or that
+// contradict a checkpoint of its network, without banning their sender
+func TestFinality(t *testing.T) {
+	// mine two branches before the miners start, so that they are longer than the miners' own chains, even if the miners
+	// mine a block meanwhile
+	newBranch := func(length int) []blockchain.Block {
+		branch := make([]blockchain.Block, 0)
+		for len(branch) < length {
+			block := blockchain.Block{
+				Header: blockchain.BlockHeader{
+					PrevHash:  blockchain.MainNetwork.GenesisHash(),
+					Summary:   blockchain.MerkleRoot([]blockchain.Post{}),
+					Timestamp: time.Now().UnixNano(),
+				},
+				Posts: []blockchain.Post{},
+			}
+			if len(branch) > 0 {
+				block.Header.PrevHash = blockchain.Hash(branch[len(branch)-1].Header)
+			}
+			MineBlock(&block)
+			branch = append(branch, block)
+		}
+		return branch
+	}
+	branch1 := newBranch(1)
+	branch2 := newBranch(4)
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	broadcast := func(port int, chain []blockchain.Block) Miner.BroadcastResultJson {
+		request := Miner.BlockChainJson{}
+		for _, block := range chain {
+			request.Blockchain = append(request.Blockchain, block.EncodeBase64())
+		}
+		data, _ := json.Marshal(request)
+		resp, err := PostAsPeer(port, "/broadcast", key, 4003, data)
+		if err != nil {
+			t.Fatalf("error when broadcasting: %v", err)
+		}
+		var result Miner.BroadcastResultJson
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		return result
+	}
+
+	// broadcast as soon as the miner is up, before it is likely to have mined a block of its own, and try a fresh miner
+	// if it has
+	start := func(port int, options ...Miner.Option) *Miner.Miner {
+		miner := Miner.NewMiner(port, 8097, options...)
+		miner.Start()
+		for i := 0; i < 200; i++ {
+			if resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", port)); err == nil {
+				resp.Body.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return miner
+	}
+	var miner *Miner.Miner
+	for attempt := 0; ; attempt++ {
+		miner = start(3025, Miner.WithFinalityDepth(0))
+		result := broadcast(3025, branch1)
+		if result.Result == Miner.BroadcastAccepted {
+			break
+		}
+		miner.Shutdown()
+		if result.Reason != "not-longer" || attempt == 2 {
+			t.Fatalf("valid blockchain is not accepted: %v", result)
+		}
+	}
+	defer miner.Shutdown()
+	// the other branch would discard a block, which is no fault of the sender, so it is ignored without counting
+	// against the sender
+	for i := 0; i < 3; i++ {
+		if result := broadcast(3025, branch2); result.Result != Miner.BroadcastIgnored || result.Reason != "finality" {
+			t.Fatalf("reorg beyond the finality depth is not refused: %v", result)
+		}
+	}
+
+	// the network's first block is fixed by a checkpoint
+	network := blockchain.MainNetwork
+	network.Checkpoints = map[int]string{0: hex.EncodeToString(blockchain.Hash(branch1[0].Header))}
+	checkpointed := start(3026, Miner.WithNetwork(network))
+	defer checkpointed.Shutdown()
+	if result := broadcast(3026, branch2); result.Result != Miner.BroadcastInvalid || result.Reason != "checkpoint" {
+		t.Fatalf("blockchain contradicting a checkpoint is not refused: %v", result)
+	}
+}
+
+// TestWeakKeys - tests that a miner refuses posts written with weak keys, whether users write them or peers broadcast
+// them in blocks
+func TestWeakKeys(t *testing.T) {
+	miner := Miner.NewMiner(3027, 8098)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	// a 1024-bit RSA key
+	weak, _ := rsa.GenerateKey(rand.Reader, 1024)
+	der, _ := x509.MarshalPKIXPublicKey(&weak.PublicKey)
+	post := blockchain.PostBase64{
+		User:      base64.StdEncoding.EncodeToString(der),
+		Content:   "Hello World",
+		Timestamp: time.Now().UnixNano(),
+		Signature: base64.StdEncoding.EncodeToString(make([]byte, 128)),
+	}
+	request, _ := json.Marshal(post)
+	resp, err := http.Post("http://localhost:3027/write", "application/json", bytes.NewReader(request))
+	if err != nil {
+		t.Fatalf("error when writing: %v", err)
+	}
+	var reply map[string]string
+	_ = json.NewDecoder(resp.Body).Decode(&reply)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || reply["error"] != "user key is weak" {
+		t.Fatalf("post by a weak key is not refused: %d %v", resp.StatusCode, reply)
+	}
+
+	// a blockchain holding the post is invalid; it is long enough not to be ignored
+	block := blockchain.BlockBase64{PrevHash: base64.StdEncoding.EncodeToString(blockchain.MainNetwork.GenesisHash())}
+	block.Posts = []blockchain.PostBase64{post}
+	chain := Miner.BlockChainJson{}
+	for i := 0; i < 10; i++ {
+		chain.Blockchain = append(chain.Blockchain, block)
+	}
+	request, _ = json.Marshal(chain)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	resp, err = PostAsPeer(3027, "/broadcast", key, 4000, request)
+	if err != nil {
+		t.Fatalf("error when broadcasting: %v", err)
+	}
+	var result Miner.BroadcastResultJson
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || result.Reason != "weak-key" || result.Index != 0 {
+		t.Fatalf("blockchain with a weak key is not rejected: %d %+v", resp.StatusCode, result)
+	}
+}
+
+// TestChainImport - tests that a miner adopts an imported blockchain, exports it back, and refuses invalid imports
+func TestChainImport(t *testing.T) {
+	// mine a blockchain of two blocks, which a new miner is unlikely to beat before it is imported
+	privateKey := blockchain.GenerateKey()
+	chain := make([]blockchain.Block, 2)
+	for i := range chain {
+		post := blockchain.Post{
+			User: &privateKey.PublicKey,
+			Body: blockchain.PostBody{Content: fmt.Sprintf("Hello %d", i), Timestamp: time.Now().UnixNano()},
+		}
+		post.Signature = blockchain.Sign(privateKey, post.Body)
+		chain[i] = blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.MainNetwork.GenesisHash(),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{post}),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Posts: []blockchain.Post{post},
+		}
+		if i > 0 {
+			chain[i].Header.PrevHash = blockchain.Hash(chain[i-1].Header)
+		}
+		MineBlock(&chain[i])
+	}
+	var export bytes.Buffer
+	_ = blockchain.ExportChain(&export, &blockchain.MainNetwork, chain)
+
+	// import as soon as the miner is up, before it is likely to have mined as many blocks, and try a fresh miner if it has
+	start := func() *Miner.Miner {
+		miner := Miner.NewMiner(3029, 8100)
+		miner.Start()
+		if err := WaitForStatus(3029, func(Miner.StatusJson) bool { return true }); err != nil {
+			t.Fatalf("miner does not start: %v", err)
+		}
+		return miner
+	}
+	importChain := func(data []byte) (int, Miner.BroadcastResultJson) {
+		resp, err := http.Post("http://localhost:3029/admin/import", "application/octet-stream", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error when importing: %v", err)
+		}
+		defer resp.Body.Close()
+		var result Miner.BroadcastResultJson
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result
+	}
+
+	// a corrupted export is refused
+	miner := start()
+	corrupted := bytes.Clone(export.Bytes())
+	corrupted[len(corrupted)-1]++
+	if status, result := importChain(corrupted); status != http.StatusBadRequest || result.Reason != "checksum" {
+		t.Fatalf("corrupted export is not refused: %d %v", status, result)
+	}
+	// the miner adopts the blockchain, and exports it back
+	for attempt := 0; ; attempt++ {
+		status, result := importChain(export.Bytes())
+		if result.Result == Miner.BroadcastAccepted {
+			break
+		}
+		miner.Shutdown()
+		if result.Reason != "not-longer" || attempt == 2 {
+			t.Fatalf("export is not imported: %d %v", status, result)
+		}
+		miner = start()
+	}
+	defer miner.Shutdown()
+	resp, err := http.Get("http://localhost:3029/admin/export")
+	if err != nil {
+		t.Fatalf("error when exporting: %v", err)
+	}
+	exported, err := blockchain.ImportChain(resp.Body, blockchain.ValidateOptions{})
+	resp.Body.Close()
+	if err != nil || len(exported) < len(chain) {
+		t.Fatalf("miner exports an invalid blockchain: %v", err)
+	}
+	for i := range chain {
+		if !bytes.Equal(exported[i].EncodeBinary(), chain[i].EncodeBinary()) {
+			t.Fatalf("miner exports a different block %d", i)
+		}
+	}
+	// importing the same blockchain again changes nothing
+	if status, result := importChain(export.Bytes()); status != http.StatusOK || result.Reason != "not-longer" {
+		t.Fatalf("imported blockchain is imported again: %d %v", status, result)
+	}
+	// blocks after the exported ones must not repeat the posts of the blocks below them
+	for len(exported) < len(chain)+4 {
+		block := blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.Hash(exported[len(exported)-1].Header),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{chain[0].Posts[0]}),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Posts: []blockchain.Post{chain[0].Posts[0]},
+		}
+		MineBlock(&block)
+		exported = append(exported, block)
+	}
+	export.Reset()
+	_ = blockchain.ExportChain(&export, &blockchain.MainNetwork, exported)
+	if status, result := importChain(export.Bytes()); status != http.StatusBadRequest ||
+		result.Reason != string(blockchain.RuleDuplicatePost) {
+		t.Fatalf("blockchain repeating a kept post is imported: %d %v", status, result)
+	}
+}
+
+// TestPruning - tests that a pruning miner keeps only the latest posts, refuses reused posts of pruned blocks, and serves
+// snapshots from which a new miner bootstraps and continues the blockchain
+func TestPruning(t *testing.T) {
+	// mine a blockchain of three blocks, which new miners are unlikely to beat before it is imported
+	privateKey := blockchain.GenerateKey()
+	chain := make([]blockchain.Block, 3)
+	for i := range chain {
+		post := blockchain.Post{
+			User: &privateKey.PublicKey,
+			Body: blockchain.PostBody{Content: fmt.Sprintf("Hello %d", i), Timestamp: time.Now().UnixNano()},
+		}
+		post.Signature = blockchain.Sign(privateKey, post.Body)
+		chain[i] = blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.MainNetwork.GenesisHash(),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{post}),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Posts: []blockchain.Post{post},
+		}
+		if i > 0 {
+			chain[i].Header.PrevHash = blockchain.Hash(chain[i-1].Header)
+		}
+		MineBlock(&chain[i])
+	}
+	var export bytes.Buffer
+	_ = blockchain.ExportChain(&export, &blockchain.MainNetwork, chain)
+
+	// miners are used as soon as they serve, and replaced if they mined too many blocks of their own meanwhile
+	start := func(port int, options ...Miner.Option) *Miner.Miner {
+		miner := Miner.NewMiner(port, 8101, options...)
+		miner.Start()
+		for i := 0; i < 200; i++ {
+			if resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", port)); err == nil {
+				resp.Body.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return miner
+	}
+	post := func(port int, path string, contentType string, data []byte) (int, Miner.BroadcastResultJson) {
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d%s", port, path), contentType, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error when posting to %s: %v", path, err)
+		}
+		var result Miner.BroadcastResultJson
+		_ = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		return resp.StatusCode, result
+	}
+
+	// the pruning miner keeps the posts of its latest block only
+	var pruning *Miner.Miner
+	for attempt := 0; ; attempt++ {
+		pruning = start(3030, Miner.WithFinalityDepth(1), Miner.WithPruning(1))
+		status, result := post(3030, "/admin/import", "application/octet-stream", export.Bytes())
+		if result.Result == Miner.BroadcastAccepted {
+			break
+		}
+		pruning.Shutdown()
+		if (result.Reason != "not-longer" && result.Reason != "finality") || attempt == 2 {
+			t.Fatalf("export is not imported: %d %v", status, result)
+		}
+	}
+	defer pruning.Shutdown()
+	resp, err := http.Get("http://localhost:3030/read")
+	if err != nil {
+		t.Fatalf("error when reading: %v", err)
+	}
+	var read Miner.ReadJson
+	_ = json.NewDecoder(resp.Body).Decode(&read)
+	resp.Body.Close()
+	if read.Pruned < 2 || read.Pruned != read.Height-1 || read.Blockchain[0].NPosts != 0 {
+		t.Fatalf("miner does not prune its blocks: pruned %d of %d", read.Pruned, read.Height)
+	}
+	if resp, err = http.Get("http://localhost:3030/admin/export"); err != nil || resp.StatusCode != http.StatusConflict {
+		t.Fatalf("pruned blockchain is exported: %v", err)
+	}
+	resp.Body.Close()
+	// posts of pruned blocks are still on the blockchain
+	write := func(port int, post blockchain.Post) int {
+		data, _ := json.Marshal(post.EncodeBase64())
+		resp, err := http.Post(fmt.Sprintf("http://localhost:%d/write", port), "application/json", bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("error when writing: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := write(3030, chain[0].Posts[0]); status != http.StatusBadRequest {
+		t.Fatalf("post of a pruned block is written again: %d", status)
+	}
+
+	// a new miner bootstraps from a snapshot of the final blocks
+	resp, err = http.Get("http://localhost:3030/admin/snapshot")
+	if err != nil {
+		t.Fatalf("error when taking a snapshot: %v", err)
+	}
+	var encoded blockchain.SnapshotBase64
+	_ = json.NewDecoder(resp.Body).Decode(&encoded)
+	resp.Body.Close()
+	snapshot, err := encoded.DecodeBase64()
+	// the miner may have mined empty blocks meanwhile
+	if err != nil || snapshot.Height() < read.Pruned || len(snapshot.Posts) != min(snapshot.Height(), len(chain)) {
+		t.Fatalf("miner returns a wrong snapshot: %v", err)
+	}
+	// the new miner starts only now, so that it is unlikely to have mined a blockchain longer than the snapshot yet
+	data, _ := json.Marshal(encoded)
+	var fresh *Miner.Miner
+	for attempt := 0; ; attempt++ {
+		fresh = start(3031)
+		status, result := post(3031, "/admin/snapshot", "application/json", data)
+		if result.Result == Miner.BroadcastAccepted {
+			break
+		}
+		fresh.Shutdown()
+		if result.Reason != "not-longer" || attempt == 2 {
+			t.Fatalf("snapshot is not loaded: %d %v", status, result)
+		}
+	}
+	defer fresh.Shutdown()
+	if status := write(3031, chain[0].Posts[0]); status != http.StatusBadRequest {
+		t.Fatalf("post of a snapshot is written again: %d", status)
+	}
+	// the new miner continues from the snapshot with the later blocks of a pruned broadcast
+	request := Miner.BlockChainJson{Blockchain: read.Blockchain}
+	data, _ = json.Marshal(request)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	resp, err = PostAsPeer(3031, "/broadcast", key, 4001, data)
+	if err != nil {
+		t.Fatalf("error when broadcasting: %v", err)
+	}
+	var result Miner.BroadcastResultJson
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	// the new miner may have mined a block on top of the snapshot meanwhile
+	if result.Reason != "not-longer" && result.Result != Miner.BroadcastAccepted {
+		t.Fatalf("pruned broadcast is not adopted: %d %v", resp.StatusCode, result)
+	}
+	if result.Result == Miner.BroadcastAccepted {
+		adopted := ReadBlockchain(3031)
+		if len(adopted) < read.Height {
+			t.Fatalf("new miner does not adopt the pruned broadcast")
+		}
+		// the pruning miner may have mined empty blocks on top of the imported ones
+		for i := snapshot.Height(); i < read.Height; i++ {
+			if len(adopted[i].Posts) != len(read.Blockchain[i].Posts) {
+				t.Fatalf("new miner does not hold the posts of the later block %d", i)
+			}
+		}
+	}
+}
+
+// TestAdminAuth - tests that the admin APIs of a miner with an admin token need the token as a bearer token
+func TestAdminAuth(t *testing.T) {
+	miner := Miner.NewMiner(3033, 8103, Miner.WithAdminToken("operator secret"))
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	bans := func(authorization string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://localhost:3033/admin/bans", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error when listing bans: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if statusCode := bans(""); statusCode != http.StatusUnauthorized {
+		t.Fatalf("admin API is served without a token: %d", statusCode)
+	}
+	if statusCode := bans("Bearer wrong"); statusCode != http.StatusUnauthorized {
+		t.Fatalf("admin API is served with a wrong token: %d", statusCode)
+	}
+	if statusCode := bans("Bearer operator secret"); statusCode != http.StatusOK {
+		t.Fatalf("admin API is not served with the token: %d", statusCode)
+	}
+	// other APIs need no token
+	resp, err := http.Get("http://localhost:3033/status")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("public API needs a token: %v", err)
+	}
+	resp.Body.Close()
+}
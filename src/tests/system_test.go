@@ -4,13 +4,14 @@ import (
 	"blockchain/blockchain"
 	Miner "blockchain/miner"
 	Tracker "blockchain/tracker"
+	"blockchain/transport"
 	User "blockchain/user"
-	"bytes"
+	"crypto/ed25519"
+	crand "crypto/rand"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
-	"net/http"
 	"reflect"
 	"testing"
 	"time"
@@ -72,18 +73,44 @@ func TestCompleteInteractions(t *testing.T) {
 // Then partition the network manually, creating 2 heads, and post 1 message to each head.
 // Finally, re-merge the network. The longer head should defeat the shorter head, and that one message posted to the
 // shorter head must return to the pool. No post should be lost in this process.
+// Each head grows by more blocks than the default finality depth during the partition, so the miners run with a
+// finality depth that covers the partition; with the default, the heads would never merge, as
+// TestPartitionBeyondFinality shows.
 func TestMergeBlockChainHeads(t *testing.T) {
 	tracker := NewPartitionTracker(8080)
 	tracker.Start()
 	time.Sleep(1000 * time.Millisecond)
 
-	// register 10 miners
+	// register 10 miners, whose finality depth covers the blocks that the merge discards
 	miners := make([]*Miner.Miner, 0)
 	for i := 0; i < 10; i++ {
-		miner := Miner.NewMiner(3000+i, 8080)
+		miner := Miner.NewMiner(3000+i, 8080, Miner.WithFinalityDepth(1000))
 		miner.Start()
 		miners = append(miners, miner)
 	}
+	// clean up, even if the test fails
+	defer func() {
+		for _, miner := range miners {
+			miner.Shutdown()
+		}
+		tracker.Shutdown()
+	}()
+	// a new block may reach one miner a moment before the other, so their blockchains are read until they agree
+	consensus := func() bool {
+		for i := 0; i < 200; i++ {
+			chain1, chain2 := ReadBlockchain(3000), ReadBlockchain(3001)
+			if len(chain1) > 0 && reflect.DeepEqual(chain1, chain2) {
+				return true
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	}
+	for _, port := range []int{3000, 3001} {
+		if err := WaitForStatus(port, func(Miner.StatusJson) bool { return true }); err != nil {
+			t.Fatalf("miner does not start: %v", err)
+		}
+	}
 	// post two messages, and then let miners mine for some time
 	err := WriteBlockchain(3000, "Hello from 0")
 	if err != nil {
@@ -95,15 +122,7 @@ func TestMergeBlockChainHeads(t *testing.T) {
 	}
 	time.Sleep(20000 * time.Millisecond)
 	// they should reach a consensus
-	chain1 := ReadBlockchain(3000)
-	if len(chain1) == 0 {
-		t.Fatalf("failed to retrieve from miner 3000")
-	}
-	chain2 := ReadBlockchain(3001)
-	if len(chain2) == 0 {
-		t.Fatalf("failed to retrieve from miner 3001")
-	}
-	if len(chain1) != len(chain2) || !reflect.DeepEqual(chain1, chain2) {
+	if !consensus() {
 		t.Fatalf("failed to reach a consensus")
 	}
 
@@ -120,11 +139,11 @@ func TestMergeBlockChainHeads(t *testing.T) {
 		t.Fatalf("failed to write to miner 3003: %v", err)
 	}
 	time.Sleep(19000 * time.Millisecond)
-	chain1 = ReadBlockchain(3000)
+	chain1 := ReadBlockchain(3000)
 	if len(chain1) == 0 {
 		t.Fatalf("failed to retrieve from miner 3000")
 	}
-	chain2 = ReadBlockchain(3001)
+	chain2 := ReadBlockchain(3001)
 	if len(chain2) == 0 {
 		t.Fatalf("failed to retrieve from miner 3001")
 	}
@@ -145,15 +164,7 @@ func TestMergeBlockChainHeads(t *testing.T) {
 	}
 	time.Sleep(20000 * time.Millisecond)
 	// they should reach a consensus
-	chain1 = ReadBlockchain(3000)
-	if len(chain1) == 0 {
-		t.Fatalf("failed to retrieve from miner 3000")
-	}
-	chain2 = ReadBlockchain(3001)
-	if len(chain2) == 0 {
-		t.Fatalf("failed to retrieve from miner 3001")
-	}
-	if len(chain1) != len(chain2) || !reflect.DeepEqual(chain1, chain2) {
+	if !consensus() {
 		t.Fatalf("failed to reach a consensus")
 	}
 	user := User.NewUser(8080)
@@ -166,12 +177,6 @@ func TestMergeBlockChainHeads(t *testing.T) {
 			t.Fatalf("wrong content of posts")
 		}
 	}
-
-	// cleanup
-	for _, miner := range miners {
-		miner.Shutdown()
-	}
-	tracker.Shutdown()
 }
 
 // TestComputingPowerAttack - Simulate a successful computing power attack to a blockchain.
@@ -179,7 +184,8 @@ func TestMergeBlockChainHeads(t *testing.T) {
 // After 5 seconds, a malicious miner with 4 goroutines start attacking. This should not be successful.
 // After 10 seconds, all but 1 miner are shut down. Now the malicious miner should be able to out-compute well-behaved
 // miners.
-// After 50 seconds, the blockchain should have been attacked successfully.
+// After 50 seconds, the malicious branch is longer, but the well-behaved miner must not have discarded any block deeper
+// than its finality depth, since the branch starts from the genesis block.
 func TestComputingPowerAttack(t *testing.T) {
 	tracker := Tracker.NewTracker(8080)
 	tracker.Start()
@@ -189,7 +195,7 @@ func TestComputingPowerAttack(t *testing.T) {
 	// set up 6 well-behaved miners
 	miners := make([]*Miner.Miner, 0)
 	for i := 0; i < 6; i++ {
-		miner := Miner.NewMiner(3000+i, 8080)
+		miner := Miner.NewMiner(3000+i, 8080, Miner.WithFinalityDepth(1))
 		miner.Start()
 		miners = append(miners, miner)
 	}
@@ -199,6 +205,8 @@ func TestComputingPowerAttack(t *testing.T) {
 	// malicious miner tries to create a branch on top of this blockchain
 	quit := make(chan bool)
 	go func() {
+		// the attacker signs its broadcasts as a node of its own
+		_, nodeKey, _ := ed25519.GenerateKey(crand.Reader)
 		attackChain := make([]blockchain.Block, 0)
 		for {
 			// set up an attack block
@@ -216,8 +224,8 @@ func TestComputingPowerAttack(t *testing.T) {
 			posts = append(posts, attackPost)
 			block := blockchain.Block{
 				Header: blockchain.BlockHeader{
-					PrevHash:  make([]byte, 32),
-					Summary:   blockchain.Hash(posts),
+					PrevHash:  blockchain.MainNetwork.GenesisHash(),
+					Summary:   blockchain.MerkleRoot(posts),
 					Timestamp: time.Now().UnixNano(),
 				},
 				Posts: posts,
@@ -244,28 +252,12 @@ func TestComputingPowerAttack(t *testing.T) {
 						// create a local copy
 						encoded := block.EncodeBase64()
 						block, _ := encoded.DecodeBase64()
-					MineIter:
 						for i := 0; i < 10000; i++ {
 							block.Header.Nonce = rand.Uint32()
-							hash := blockchain.Hash(block.Header)
-							zeroBytes := blockchain.TARGET / 8
-							zeroBits := blockchain.TARGET % 8
-							// the first zeroBytes bytes of hash must be zero
-							for i := 0; i < zeroBytes; i++ {
-								if hash[i] != 0 {
-									continue MineIter
-								}
+							if blockchain.MeetsTarget(block.Header.Hash()) {
+								chanNonce <- block.Header.Nonce
+								return
 							}
-							// and then zeroBits bits of hash must be zero
-							if zeroBits > 0 {
-								nextByte := hash[zeroBytes]
-								nextByte = nextByte >> (8 - zeroBits)
-								if nextByte != 0 {
-									continue MineIter
-								}
-							}
-							chanNonce <- block.Header.Nonce
-							return
 						}
 						chanNonce <- 0
 					}()
@@ -290,9 +282,7 @@ func TestComputingPowerAttack(t *testing.T) {
 			for i := 0; i < 6; i++ {
 				request := Miner.BlockChainJson{Blockchain: encodedChain}
 				reqJson, _ := json.Marshal(request)
-				resp, _ := http.Post(
-					fmt.Sprintf("http://localhost:%d/broadcast", 3000+i),
-					"application/json", bytes.NewReader(reqJson))
+				resp, _ := PostAsPeer(3000+i, "/broadcast", nodeKey, 4000, reqJson)
 				if resp != nil && resp.Body != nil {
 					resp.Body.Close()
 				}
@@ -300,6 +290,15 @@ func TestComputingPowerAttack(t *testing.T) {
 		}
 	}()
 	t.Log("Started malicious miners")
+	// clean up, even if the test fails
+	defer func() {
+		for _, miner := range miners {
+			miner.Shutdown()
+		}
+		quit <- true
+		<-quit
+		tracker.Shutdown()
+	}()
 
 	// well-behaved miners should be able to out-compute malicious miners
 	time.Sleep(10000 * time.Millisecond)
@@ -315,22 +314,118 @@ func TestComputingPowerAttack(t *testing.T) {
 	for i := 1; i < 6; i++ {
 		miners[i].Shutdown()
 	}
+	miners = miners[:1]
 	t.Log("Shut down 5 miners")
-	// now the malicious miner should out-compute well-behaved miners
+	history := ReadBlockchain(3000)
+	// now the malicious miner should out-compute well-behaved miners, but cannot rewrite blocks beyond the finality depth
 	time.Sleep(50000 * time.Millisecond)
+	final := len(history) - 1
+	chain := ReadBlockchain(3000)
+	if final > 0 && (len(chain) < final || !reflect.DeepEqual(chain[:final], history[:final])) {
+		t.Fatalf("blocks beyond the finality depth are rewritten by malicious miners\n")
+	}
 	posts, err = user.ReadPosts()
 	if err != nil {
 		t.Fatalf("error when reading posts: %v\n", err)
 	}
-	if len(posts) == 0 {
-		t.Fatalf("malicious miners did not out-compute well-behaved miners\n")
+	if final > 0 && len(posts) != 0 {
+		t.Fatalf("blockchain is attacked by malicious miners\n")
+	}
+}
+
+// TestPartitionBeyondFinality - tests that the parts of a partitioned network do not converge once the partition ends if
+// each has mined more blocks than the default finality depth: each refuses the other's blockchain as a deep reorg.
+func TestPartitionBeyondFinality(t *testing.T) {
+	tracker := NewPartitionTracker(8106)
+	tracker.Partition(true)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	// the partition tracker splits miners by the parity of their ports
+	ports := []int{3036, 3037}
+	for _, port := range ports {
+		miner := Miner.NewMiner(port, 8106)
+		miner.Start()
+		defer miner.Shutdown()
+	}
+	// both parts mine beyond the finality depth on their own
+	for _, port := range ports {
+		for i := 0; i < 1200 && len(ReadBlockchain(port)) <= Miner.FinalityDepth; i++ {
+			time.Sleep(100 * time.Millisecond)
+		}
+		if len(ReadBlockchain(port)) <= Miner.FinalityDepth {
+			t.Fatalf("miner %d does not mine beyond the finality depth", port)
+		}
 	}
 
-	// clean up
-	for i := 0; i < 1; i++ {
-		miners[i].Shutdown()
+	t.Log("Re-merging the network...")
+	tracker.Partition(false)
+	time.Sleep(5000 * time.Millisecond)
+	chain1, chain2 := ReadBlockchain(ports[0]), ReadBlockchain(ports[1])
+	if len(chain1) == 0 || len(chain2) == 0 {
+		t.Fatalf("failed to retrieve from the miners")
+	}
+	if reflect.DeepEqual(chain1[0], chain2[0]) {
+		t.Fatalf("parts of the network converge after a reorg beyond the finality depth")
+	}
+	refused := 0.0
+	for _, port := range ports {
+		samples, _ := ScrapeMetrics(port)
+		refused += samples[`miner_broadcasts_ignored_total{reason="finality"}`]
+	}
+	if refused == 0 {
+		t.Fatalf("broadcasts of the other part are not refused")
+	}
+}
+
+// TestTLS - tests that a tracker, a miner and a user can talk over mutual TLS, and that clients without a trusted
+// certificate are refused
+func TestTLS(t *testing.T) {
+	ca, err := transport.NewCA()
+	if err != nil {
+		t.Fatalf("error when creating CA: %v", err)
+	}
+	trackerTLS, _ := ca.Config(true)
+	minerTLS, _ := ca.Config(true)
+	certFile, keyFile, caFile, err := ca.WriteFiles(t.TempDir())
+	if err != nil {
+		t.Fatalf("error when writing certificates: %v", err)
+	}
+	userTLS, err := transport.LoadConfig(certFile, keyFile, caFile, "")
+	if err != nil {
+		t.Fatalf("error when loading certificates: %v", err)
+	}
+
+	tracker := Tracker.NewTracker(8091, Tracker.WithTLS(trackerTLS))
+	tracker.Start()
+	defer tracker.Shutdown()
+	miner := Miner.NewMiner(3017, 8091, Miner.WithTLS(minerTLS))
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+
+	// the miner has registered over TLS, and the user reaches both nodes
+	user := User.NewUser(8091, User.WithTLS(userTLS))
+	miners, err := user.GetRandomMiners()
+	if err != nil || len(miners) != 1 || miners[0] != 3017 {
+		t.Fatalf("miner is not registered over TLS: %v %v", miners, err)
+	}
+	if err := user.WritePost("Encrypted content"); err != nil {
+		t.Fatalf("error when posting over TLS: %v", err)
+	}
+
+	// plain HTTP, untrusted servers and missing client certificates are all refused
+	if _, err := User.NewUser(8091).GetRandomMiners(); err == nil {
+		t.Fatalf("plain HTTP is accepted")
+	}
+	other, _ := transport.NewCA()
+	untrusted, _ := other.Config(false)
+	if _, err := User.NewUser(8091, User.WithTLS(untrusted)).GetRandomMiners(); err == nil {
+		t.Fatalf("untrusted server is accepted")
+	}
+	anonymous := &transport.Config{RootCAs: ca.Pool()}
+	if _, err := User.NewUser(8091, User.WithTLS(anonymous)).GetRandomMiners(); err == nil {
+		t.Fatalf("client without certificate is accepted")
 	}
-	quit <- true
-	<-quit
-	tracker.Shutdown()
 }
@@ -1,10 +1,14 @@
 package tests
 
 import (
+	"blockchain/blockchain"
 	Miner "blockchain/miner"
 	Tracker "blockchain/tracker"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"testing"
 	"time"
@@ -30,7 +34,7 @@ func TestMinerDiscovery(t *testing.T) {
 	}
 	time.Sleep(500 * time.Millisecond)
 	// initialize a mock miner at 3002
-	request := Tracker.PortJson{Port: 3002}
+	request := Tracker.PortJson{Port: 3002, Network: blockchain.MainNetwork.ID()}
 	reqBytes, _ := json.Marshal(request)
 	url := "http://localhost:8080/register"
 	resp, err := http.Post(url, "application/json", bytes.NewReader(reqBytes))
@@ -52,7 +56,7 @@ func TestMinerDiscovery(t *testing.T) {
 	// wait for 3002 miner to timeout
 	time.Sleep(1000 * time.Millisecond)
 	// initialize a mock miner at 3003
-	request = Tracker.PortJson{Port: 3003}
+	request = Tracker.PortJson{Port: 3003, Network: blockchain.MainNetwork.ID()}
 	reqBytes, _ = json.Marshal(request)
 	resp, err = http.Post(url, "application/json", bytes.NewReader(reqBytes))
 	if err != nil {
@@ -80,3 +84,93 @@ func TestMinerDiscovery(t *testing.T) {
 	}
 	tracker.Shutdown()
 }
+
+// TestNetworks checks that nodes of different networks never mix: the tracker refuses miners of other networks, a
+// miner's chain starts from its own network's genesis block, and miners refuse requests from peers of other networks.
+func TestNetworks(t *testing.T) {
+	network := blockchain.Network{Name: "test", Magic: 1, Timestamp: time.Now().UnixNano()}
+	if network.ID() == blockchain.MainNetwork.ID() {
+		t.Fatalf("different networks have the same ID")
+	}
+	tracker := Tracker.NewTracker(8096, Tracker.WithNetwork(network))
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	register := func(networkID string) int {
+		reqBytes, _ := json.Marshal(Tracker.PortJson{Port: 3099, Network: networkID})
+		resp, err := http.Post("http://localhost:8096/register", "application/json", bytes.NewReader(reqBytes))
+		if err != nil {
+			t.Fatalf("failed to connect to tracker")
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := register(blockchain.MainNetwork.ID()); code != http.StatusForbidden {
+		t.Fatalf("miner of another network is registered: %d", code)
+	}
+	if code := register(network.ID()); code != http.StatusOK {
+		t.Fatalf("miner of the network is not registered: %d", code)
+	}
+
+	// a chain of the main network does not start from the network's genesis block; it is mined before the miner starts,
+	// so that it is longer than the miner's own chain when it is broadcast
+	chain := make([]blockchain.Block, 0)
+	for len(chain) < 5 {
+		block := blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.MainNetwork.GenesisHash(),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{}),
+				Timestamp: time.Now().UnixNano(),
+			},
+			Posts: []blockchain.Post{},
+		}
+		if len(chain) > 0 {
+			block.Header.PrevHash = blockchain.Hash(chain[len(chain)-1].Header)
+		}
+		MineBlock(&block)
+		chain = append(chain, block)
+	}
+	var invalid *blockchain.ValidationError
+	err := blockchain.ValidateChain(chain, blockchain.ValidateOptions{Network: &network})
+	if !errors.As(err, &invalid) || invalid.Rule != blockchain.RuleGenesis || invalid.Height != 0 {
+		t.Fatalf("chain of another network is valid: %v", err)
+	}
+
+	miner := Miner.NewMiner(3024, 8096, Miner.WithNetwork(network))
+	miner.Start()
+	defer miner.Shutdown()
+	if err := WaitForStatus(3024, func(Miner.StatusJson) bool { return true }); err != nil {
+		t.Fatalf("miner does not start: %v", err)
+	}
+
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	request := Miner.BlockChainJson{}
+	for _, block := range chain {
+		request.Blockchain = append(request.Blockchain, block.EncodeBase64())
+	}
+	body, _ := json.Marshal(request)
+	req, _ := http.NewRequest(http.MethodPost, "http://localhost:3024/broadcast", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	Miner.SignRequest(req, key, 4002, network.ID(), body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to connect to miner")
+	}
+	var result Miner.BroadcastResultJson
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || result.Reason != string(blockchain.RuleGenesis) || result.Index != 0 {
+		t.Fatalf("chain of another network is not rejected: %d %v", resp.StatusCode, result)
+	}
+
+	// PostAsPeer sends requests as a miner of the main network
+	resp, err = PostAsPeer(3024, "/sync", key, 4002, []byte(`{"posts": []}`))
+	if err != nil {
+		t.Fatalf("failed to connect to miner")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("request from another network is not refused: %d", resp.StatusCode)
+	}
+}
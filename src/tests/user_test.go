@@ -1,12 +1,25 @@
 package tests
 
 import (
+	"blockchain/blockchain"
+	Miner "blockchain/miner"
+	Tracker "blockchain/tracker"
 	"blockchain/user"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 // TestNewUser tests the creation of a new user and verifies that attempting to retrieve miners without a running tracker results in an error.
@@ -63,3 +76,501 @@ func extractPort(url string) int {
 	}
 	return port
 }
+
+// TestReadOptions tests paginated and filtered reads against a single miner.
+// Two users each write a post. Once both posts are on the blockchain, the test reads headers one page at a time
+// and checks that they match the complete blockchain, and then filters posts by author and by timestamp.
+func TestReadOptions(t *testing.T) {
+	tracker := Tracker.NewTracker(8084)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3010, 8084)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	users := []*user.User{user.NewUser(8084), user.NewUser(8084)}
+	for i, u := range users {
+		if err := u.WritePost(fmt.Sprintf("Hello from %d", i)); err != nil {
+			t.Fatalf("error when posting: %v", err)
+		}
+	}
+	// wait for both posts to be mined
+	var posts []user.Post
+	for i := 0; i < 60 && len(posts) < 2; i++ {
+		time.Sleep(1000 * time.Millisecond)
+		posts, _ = users[0].ReadPosts()
+	}
+	if len(posts) != 2 {
+		t.Fatalf("posts are not mined in time")
+	}
+
+	// read headers page by page
+	chain := ReadBlockchain(3010)
+	headers, err := users[0].ReadHeaders(user.ReadOptions{PageSize: 1})
+	if err != nil {
+		t.Fatalf("error when reading headers: %v", err)
+	}
+	if len(headers) < len(chain) {
+		t.Fatalf("paginated read returns %d headers, expected at least %d", len(headers), len(chain))
+	}
+	for i := range chain {
+		if !reflect.DeepEqual(headers[i], chain[i].Header) {
+			t.Fatalf("header %d differs from the complete blockchain", i)
+		}
+	}
+
+	// filter by author
+	posts, err = users[0].ReadPosts(user.ReadOptions{Author: users[1].PublicKey(), PageSize: 2})
+	if err != nil {
+		t.Fatalf("error when reading posts by author: %v", err)
+	}
+	if len(posts) != 1 || posts[0].Body.Content != "Hello from 1" {
+		t.Fatalf("author filter returns wrong posts")
+	}
+
+	// filter by timestamp
+	all, _ := users[0].ReadPosts()
+	posts, err = users[0].ReadPosts(user.ReadOptions{Since: all[1].Body.Timestamp})
+	if err != nil {
+		t.Fatalf("error when reading posts by timestamp: %v", err)
+	}
+	if len(posts) != 1 || posts[0].Body.Content != "Hello from 1" {
+		t.Fatalf("timestamp filter returns wrong posts")
+	}
+}
+
+// TestLyingMiner tests that a miner cannot win a read by claiming a height that it does not back with blocks.
+// A mock miner answers every read with a huge height and no blocks, and the read must fail instead of returning no posts.
+func TestLyingMiner(t *testing.T) {
+	liar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Miner.ReadJson{Height: 1000000, Blockchain: []blockchain.BlockBase64{}})
+	}))
+	defer liar.Close()
+	trackerServer := httptest.NewServer(http.HandlerFunc(newMockTracker([]int{extractPort(liar.URL)}).handleGetMiners))
+	defer trackerServer.Close()
+
+	newUser := user.NewUser(extractPort(trackerServer.URL))
+	if posts, err := newUser.ReadPosts(); err == nil {
+		t.Fatalf("read from a lying miner returns %d posts without an error", len(posts))
+	}
+	if _, err := newUser.ReadHeaders(); err == nil {
+		t.Fatalf("header read from a lying miner succeeds")
+	}
+	if _, err := newUser.Subscribe(context.Background(), user.ReadOptions{From: 5}); err == nil {
+		t.Fatalf("subscription from a height that no miner proves succeeds")
+	}
+}
+
+// TestSubscribe tests that a subscription yields a post once it is mined, and closes when it is cancelled.
+func TestSubscribe(t *testing.T) {
+	tracker := Tracker.NewTracker(8085)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3011, 8085)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	u := user.NewUser(8085)
+	ctx, cancel := context.WithCancel(context.Background())
+	posts, err := u.Subscribe(ctx, user.ReadOptions{Author: u.PublicKey()})
+	if err != nil {
+		t.Fatalf("error when subscribing: %v", err)
+	}
+	if err := u.WritePost("Hello subscribers"); err != nil {
+		t.Fatalf("error when posting: %v", err)
+	}
+	select {
+	case post := <-posts:
+		if post.Body.Content != "Hello subscribers" {
+			t.Fatalf("wrong content of the streamed post: %s", post.Body.Content)
+		}
+	case <-time.After(60 * time.Second):
+		t.Fatalf("post is not streamed in time")
+	}
+
+	cancel()
+	for range posts {
+		// drain until the subscription is closed
+	}
+}
+
+// TestSubscribeBlockTime tests that a subscription does not yield the posts of blocks that are dated before the blocks
+// below them or too far in the future.
+func TestSubscribeBlockTime(t *testing.T) {
+	privateKey := blockchain.GenerateKey()
+	mine := func(content string, timestamp time.Time, prev *blockchain.Block) blockchain.Block {
+		post := blockchain.Post{
+			User: &privateKey.PublicKey,
+			Body: blockchain.PostBody{Content: content, Timestamp: timestamp.UnixNano()},
+		}
+		post.Signature = blockchain.Sign(privateKey, post.Body)
+		block := blockchain.Block{
+			Header: blockchain.BlockHeader{
+				PrevHash:  blockchain.MainNetwork.GenesisHash(),
+				Summary:   blockchain.MerkleRoot([]blockchain.Post{post}),
+				Timestamp: timestamp.UnixNano(),
+			},
+			Posts: []blockchain.Post{post},
+		}
+		if prev != nil {
+			block.Header.PrevHash = blockchain.Hash(prev.Header)
+		}
+		MineBlock(&block)
+		return block
+	}
+	now := time.Now()
+	first := mine("Hello", now, nil)
+	// each stream follows the first block with one that is dated before it or one from the future, in turn
+	next := []blockchain.Block{
+		mine("Hello from the past", now.Add(-time.Second), &first),
+		mine("Hello from the future", now.Add(time.Hour), &first),
+	}
+
+	streams := 0
+	var lock sync.Mutex
+	liar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		block := next[streams%len(next)]
+		streams++
+		lock.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		for height, block := range []blockchain.Block{first, block} {
+			encoded := block.EncodeBase64()
+			data, _ := json.Marshal(Miner.EventJson{Type: Miner.EventBlock, Height: height, Block: &encoded})
+			_, _ = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", Miner.EventBlock, data)
+		}
+	}))
+	defer liar.Close()
+	trackerServer := httptest.NewServer(http.HandlerFunc(newMockTracker([]int{extractPort(liar.URL)}).handleGetMiners))
+	defer trackerServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	posts, err := user.NewUser(extractPort(trackerServer.URL)).Subscribe(ctx, user.ReadOptions{})
+	if err != nil {
+		t.Fatalf("error when subscribing: %v", err)
+	}
+	timeout := time.After(5 * time.Second)
+	received := 0
+Receive:
+	for {
+		select {
+		case post := <-posts:
+			if post.Body.Content != "Hello" || received > 0 {
+				t.Fatalf("subscription yields the post of a misdated block: %s", post.Body.Content)
+			}
+			received++
+		case <-timeout:
+			break Receive
+		}
+	}
+	if received == 0 {
+		t.Fatalf("subscription does not yield the post of the first block")
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if streams < len(next) {
+		t.Fatalf("subscription does not reconnect after a misdated block: %d streams", streams)
+	}
+}
+
+// TestKeystore tests that identities saved in a keystore survive reopening it, are encrypted with their passphrases,
+// are never overwritten, and give users that sign with the saved keys.
+func TestKeystore(t *testing.T) {
+	dir := t.TempDir()
+	keystore, err := user.OpenKeystore(dir)
+	if err != nil {
+		t.Fatalf("failed to open keystore: %v", err)
+	}
+	alice := blockchain.GenerateKey()
+	bob, _ := blockchain.GenerateKeyWith(blockchain.SchemeECDSA)
+	if err := keystore.Save("alice", "correct horse", alice); err != nil {
+		t.Fatalf("failed to save identity: %v", err)
+	}
+	if err := keystore.Save("bob", "battery staple", bob); err != nil {
+		t.Fatalf("failed to save identity: %v", err)
+	}
+	if err := keystore.Save("alice", "correct horse", bob); !errors.Is(err, user.ErrIdentityExists) {
+		t.Fatalf("identity is overwritten: %v", err)
+	}
+	if err := keystore.Save("../alice", "correct horse", bob); err == nil {
+		t.Fatalf("identity with a path as its name is saved")
+	}
+	info, err := os.Stat(filepath.Join(dir, "alice.key.json"))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("key file is not private: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "alice.key.json"))
+	if bytes.Contains(data, blockchain.PrivateKeyToBytes(alice)) || bytes.Contains(data, []byte(base64.StdEncoding.EncodeToString(blockchain.PrivateKeyToBytes(alice)))) {
+		t.Fatalf("private key is stored in the clear")
+	}
+
+	// identities are listed without their passphrases, after reopening the keystore
+	keystore, _ = user.OpenKeystore(dir)
+	identities, err := keystore.List()
+	if err != nil || len(identities) != 2 || identities[0].Name != "alice" || identities[1].Name != "bob" ||
+		!reflect.DeepEqual(*identities[1].PublicKey, bob.PublicKey) {
+		t.Fatalf("identities are not listed correctly: %+v %v", identities, err)
+	}
+	loaded, err := keystore.Load("bob", "battery staple")
+	if err != nil || !reflect.DeepEqual(loaded.PublicKey, bob.PublicKey) {
+		t.Fatalf("identity is not loaded correctly: %v", err)
+	}
+	post := blockchain.Post{User: &bob.PublicKey, Body: blockchain.PostBody{Content: "Hello World"}}
+	post.Signature = blockchain.Sign(loaded, post.Body)
+	if !post.Verify() {
+		t.Fatalf("loaded key does not sign for the saved identity")
+	}
+	if _, err := keystore.Load("bob", "wrong"); !errors.Is(err, user.ErrWrongPassphrase) {
+		t.Fatalf("identity is loaded with a wrong passphrase: %v", err)
+	}
+	if _, err := keystore.Load("carol", "wrong"); !errors.Is(err, user.ErrIdentityNotFound) {
+		t.Fatalf("missing identity is loaded: %v", err)
+	}
+
+	// swapping the public key of a key file is detected
+	var file user.KeyFileJson
+	_ = json.Unmarshal(data, &file)
+	file.PublicKey = base64.StdEncoding.EncodeToString(blockchain.PublicKeyToBytes(&bob.PublicKey))
+	data, _ = json.Marshal(file)
+	_ = os.WriteFile(filepath.Join(dir, "alice.key.json"), data, 0o600)
+	if _, err := keystore.Load("alice", "correct horse"); !errors.Is(err, user.ErrWrongPassphrase) {
+		t.Fatalf("tampered key file is loaded: %v", err)
+	}
+	// so is a key file demanding an excessive key derivation, before any work is done
+	file.KDFParams.N = 1 << 30
+	data, _ = json.Marshal(file)
+	_ = os.WriteFile(filepath.Join(dir, "alice.key.json"), data, 0o600)
+	if _, err := keystore.Load("alice", "correct horse"); err == nil || errors.Is(err, user.ErrWrongPassphrase) {
+		t.Fatalf("key file with excessive scrypt parameters is not refused: %v", err)
+	}
+
+	// a user keeps the identity
+	newUser, err := user.NewUserFromKeystore(8000, keystore, "bob", "battery staple")
+	if err != nil || !reflect.DeepEqual(*newUser.PublicKey(), bob.PublicKey) {
+		t.Fatalf("user does not have the saved identity: %v", err)
+	}
+	if _, err := user.NewUserFromKeystore(8000, keystore, "bob", "wrong"); err == nil {
+		t.Fatalf("user is created with a wrong passphrase")
+	}
+
+	if err := keystore.Delete("bob"); err != nil {
+		t.Fatalf("failed to delete identity: %v", err)
+	}
+	if err := keystore.Delete("bob"); !errors.Is(err, user.ErrIdentityNotFound) {
+		t.Fatalf("deleted identity is deleted again: %v", err)
+	}
+}
+
+// TestKeyRotation tests that readers attribute the posts of a rotated key and of its new key to the same identity, and
+// flag the posts that a leaked key writes after it is revoked.
+func TestKeyRotation(t *testing.T) {
+	tracker := Tracker.NewTracker(8099)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3028, 8099)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	// waitFor reads posts until there are at least n of them
+	waitFor := func(u *user.User, n int) []user.Post {
+		var posts []user.Post
+		for i := 0; i < 90 && len(posts) < n; i++ {
+			time.Sleep(1000 * time.Millisecond)
+			posts, _ = u.ReadPosts()
+		}
+		if len(posts) < n {
+			t.Fatalf("posts are not mined in time")
+		}
+		return posts
+	}
+
+	oldKey := blockchain.GenerateKey()
+	newKey := blockchain.GenerateKey()
+	alice := user.NewUser(8099, user.WithKey(oldKey))
+	if err := alice.WritePost("before"); err != nil {
+		t.Fatalf("error when posting: %v", err)
+	}
+	if err := alice.RotateKey(newKey, "rotating"); err != nil {
+		t.Fatalf("error when rotating: %v", err)
+	}
+	if !reflect.DeepEqual(*alice.PublicKey(), newKey.PublicKey) {
+		t.Fatalf("user does not sign with the new key")
+	}
+	if err := alice.WritePost("after"); err != nil {
+		t.Fatalf("error when posting: %v", err)
+	}
+	if err := alice.RevokeKey(oldKey, "leaked"); err != nil {
+		t.Fatalf("error when revoking: %v", err)
+	}
+	waitFor(alice, 4)
+
+	// the leaked key writes after its revocation is on the blockchain
+	thief := user.NewUser(8099, user.WithKey(oldKey))
+	if err := thief.WritePost("forged"); err != nil {
+		t.Fatalf("error when posting: %v", err)
+	}
+	posts := waitFor(alice, 5)
+
+	byContent := make(map[string]user.Post)
+	for _, post := range posts {
+		byContent[post.Body.Content] = post
+	}
+	for _, content := range []string{"before", "rotating", "after", "leaked", "forged"} {
+		post := byContent[content]
+		if post.Identity == nil || !reflect.DeepEqual(*post.Identity, oldKey.PublicKey) {
+			t.Fatalf("post %q is not attributed to the identity", content)
+		}
+		if post.Revoked != (content == "forged") {
+			t.Fatalf("post %q is flagged wrongly: %v", content, post.Revoked)
+		}
+	}
+	if !reflect.DeepEqual(*byContent["after"].User, newKey.PublicKey) {
+		t.Fatalf("post after the rotation is not signed with the new key")
+	}
+	if byContent["forged"].Height <= byContent["leaked"].Height {
+		t.Fatalf("heights of posts are wrong: %d %d", byContent["forged"].Height, byContent["leaked"].Height)
+	}
+
+	// a read filtered by author does not resolve identities, unless it is asked to resolve the rotation and revocation
+	// that it does not return
+	filter := user.ReadOptions{Author: &oldKey.PublicKey, Since: byContent["forged"].Body.Timestamp}
+	posts, err := alice.ReadPosts(filter)
+	if err != nil || len(posts) != 1 || posts[0].Body.Content != "forged" {
+		t.Fatalf("filtered read returns wrong posts: %v", err)
+	}
+	if posts[0].Revoked || !reflect.DeepEqual(*posts[0].Identity, oldKey.PublicKey) {
+		t.Fatalf("filtered read resolves identities unasked")
+	}
+	filter.Identities = true
+	posts, err = alice.ReadPosts(filter)
+	if err != nil || len(posts) != 1 || posts[0].Body.Content != "forged" {
+		t.Fatalf("filtered read returns wrong posts: %v", err)
+	}
+	if !posts[0].Revoked || !reflect.DeepEqual(*posts[0].Identity, oldKey.PublicKey) {
+		t.Fatalf("filtered read does not resolve the revocation")
+	}
+
+	// subscriptions resolve identities as reads do, from the blocks below their first height only if they are asked to
+	subscribe := func(filter user.ReadOptions, n int) map[string]user.Post {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		defer cancel()
+		stream, err := alice.Subscribe(ctx, filter)
+		if err != nil {
+			t.Fatalf("error when subscribing: %v", err)
+		}
+		streamed := make(map[string]user.Post)
+		for post := range stream {
+			streamed[post.Body.Content] = post
+			if len(streamed) == n {
+				return streamed
+			}
+		}
+		t.Fatalf("posts are not streamed in time")
+		return nil
+	}
+	streamed := subscribe(user.ReadOptions{}, 5)
+	for content, post := range byContent {
+		if !reflect.DeepEqual(streamed[content].Identity, post.Identity) || streamed[content].Revoked != post.Revoked {
+			t.Fatalf("streamed post %q is resolved differently from the read one", content)
+		}
+	}
+	forged := user.ReadOptions{From: byContent["forged"].Height, Author: &oldKey.PublicKey}
+	if streamed = subscribe(forged, 1); streamed["forged"].Revoked {
+		t.Fatalf("subscription resolves identities below its first height unasked")
+	}
+	forged.Identities = true
+	if streamed = subscribe(forged, 1); !streamed["forged"].Revoked {
+		t.Fatalf("subscription does not resolve the revocation below its first height")
+	}
+
+	// a miner that leaves the revocation out of complete blocks cannot get the forged post read as unrevoked
+	liar := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get("http://localhost:3028" + r.URL.RequestURI())
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		var read Miner.ReadJson
+		_ = json.NewDecoder(resp.Body).Decode(&read)
+		for i, encoded := range read.Blockchain {
+			block, err := encoded.DecodeBase64()
+			if err != nil || r.URL.Query().Has("author") {
+				continue
+			}
+			kept := make([]blockchain.Post, 0)
+			for _, post := range block.Posts {
+				if post.Body.Kind != blockchain.PostRevoke {
+					kept = append(kept, post)
+				}
+			}
+			block.Posts = kept
+			read.Blockchain[i] = block.EncodeBase64()
+		}
+		_ = json.NewEncoder(w).Encode(read)
+	}))
+	defer liar.Close()
+	trackerServer := httptest.NewServer(http.HandlerFunc(newMockTracker([]int{extractPort(liar.URL)}).handleGetMiners))
+	defer trackerServer.Close()
+	reader := user.NewUser(extractPort(trackerServer.URL))
+	posts, err = reader.ReadPosts(filter)
+	if err == nil {
+		t.Fatalf("filtered read resolves identities from blocks without their revocations: %+v", posts)
+	}
+}
+
+// TestLightClient tests that a light client verifies a post with a Merkle proof against the header chain, which it
+// extends without reading it again, and that posts that are not on the blockchain are not proven.
+func TestLightClient(t *testing.T) {
+	tracker := Tracker.NewTracker(8102)
+	tracker.Start()
+	defer tracker.Shutdown()
+	time.Sleep(1000 * time.Millisecond)
+	miner := Miner.NewMiner(3032, 8102)
+	miner.Start()
+	defer miner.Shutdown()
+	time.Sleep(500 * time.Millisecond)
+
+	alice := user.NewUser(8102)
+	if err := alice.WritePost("Hello light"); err != nil {
+		t.Fatalf("error when posting: %v", err)
+	}
+	var posts []user.Post
+	for i := 0; i < 60 && len(posts) < 1; i++ {
+		time.Sleep(1000 * time.Millisecond)
+		posts, _ = alice.ReadPosts()
+	}
+	if len(posts) != 1 {
+		t.Fatalf("post is not mined in time")
+	}
+
+	light := user.NewUser(8102)
+	post, err := light.ReadPost(alice.PublicKey(), posts[0].Body.Timestamp)
+	if err != nil {
+		t.Fatalf("error when reading a post with a proof: %v", err)
+	}
+	if post.Body.Content != "Hello light" || post.Height != posts[0].Height {
+		t.Fatalf("light client reads a wrong post: %q at height %d", post.Body.Content, post.Height)
+	}
+	if _, err := light.ReadPost(alice.PublicKey(), posts[0].Body.Timestamp+1); err == nil {
+		t.Fatalf("post that is not on the blockchain is proven")
+	}
+
+	// the header chain is extended with the blocks mined meanwhile
+	height, err := light.SyncHeaders()
+	if err != nil || height <= post.Height {
+		t.Fatalf("header chain is not synced: height %d, %v", height, err)
+	}
+	chain := ReadBlockchain(3032)
+	headers, _ := light.ReadHeaders()
+	if len(chain) < height || len(headers) < height || !reflect.DeepEqual(headers[height-1], chain[height-1].Header) {
+		t.Fatalf("header chain differs from the blockchain")
+	}
+}
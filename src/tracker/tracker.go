@@ -1,44 +1,116 @@
 package tracker
 
 import (
+	"blockchain/blockchain"
+	"blockchain/logging"
+	"blockchain/metrics"
+	"blockchain/transport"
 	"context"
 	"errors"
-	"fmt"
 	"github.com/gin-gonic/gin"
-	"log"
+	"log/slog"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // EntryTimeout - A miner entry expires after EntryTimeout, if no heartbeats are received.
 const EntryTimeout = 500 * time.Millisecond
 
+// MaxRegisterRequestSize - Maximum size in bytes of a /register request body.
+const MaxRegisterRequestSize = 1024
+
 type PortJson struct {
-	Port int `json:"port"`
+	Port    int    `json:"port"`
+	Network string `json:"network"` // ID of the network the miner belongs to
 }
 
 type PortsJson struct {
 	Ports []int `json:"ports"`
 }
 
+// StatusJson - response of /status.
+type StatusJson struct {
+	Port     int               `json:"port"`
+	Network  string            `json:"network"` // ID of the network the tracker serves
+	Version  string            `json:"version"`
+	Uptime   int64             `json:"uptime"`   // milliseconds since the tracker started
+	Miners   int               `json:"miners"`   // number of registered miners
+	Requests map[string]uint64 `json:"requests"` // number of requests received by each API
+}
+
 // Tracker - A Tracker in the blockchain system.
 type Tracker struct {
-	miners map[int]*time.Timer // maps each miner's port to its expiration timer
-	lock   sync.Mutex          // protects miners for concurrent access
-	router *gin.Engine         // http router
-	server *http.Server        // http server
+	miners  map[int]*time.Timer // maps each miner's port to its expiration timer
+	lock    sync.Mutex          // protects miners for concurrent access
+	port    int                 // http port
+	started time.Time           // when the tracker started
+	router  *gin.Engine         // http router
+	server  *http.Server        // http server
+
+	registerCount  atomic.Uint64 // number of /register requests
+	getMinersCount atomic.Uint64 // number of /get_miners requests
+	statusCount    atomic.Uint64 // number of /status requests
+
+	metrics       *metrics.Registry // metrics exposed on /metrics
+	registrations *metrics.Counter  // registrations of miners that were not registered
+	expirations   *metrics.Counter  // miner entries that expired without heartbeats
+	network       string            // ID of the network whose miners may register
+	tls           *transport.Config // TLS settings, nil for plain HTTP
+	logger        *slog.Logger      // logger carrying the tracker's port in every record
+}
+
+// Option - an optional setting of NewTracker.
+type Option func(t *Tracker)
+
+// WithLogger - sends the tracker's logs to logger instead of slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(t *Tracker) {
+		t.logger = logger
+	}
+}
+
+// WithTLS - serves the tracker's APIs over TLS.
+func WithTLS(config *transport.Config) Option {
+	return func(t *Tracker) {
+		t.tls = config
+	}
+}
+
+// WithNetwork - serves miners of network instead of blockchain.MainNetwork.
+func WithNetwork(network blockchain.Network) Option {
+	return func(t *Tracker) {
+		t.network = network.ID()
+	}
 }
 
 // NewTracker - creates a new Tracker, but does not start its http server yet.
-func NewTracker(port int) *Tracker {
+func NewTracker(port int, options ...Option) *Tracker {
 	tracker := &Tracker{
-		miners: make(map[int]*time.Timer),
-		router: gin.New(),
+		miners:  make(map[int]*time.Timer),
+		port:    port,
+		router:  gin.New(),
+		network: blockchain.MainNetwork.ID(),
+		logger:  slog.Default(),
 	}
+	for _, option := range options {
+		option(tracker)
+	}
+	tracker.logger = tracker.logger.With("node", "tracker", "port", port)
+	tracker.router.Use(logging.Middleware(tracker.logger))
+	tracker.metrics = metrics.NewRegistry()
+	tracker.registrations = tracker.metrics.Counter("tracker_registrations_total", "Number of new miners registered.")
+	tracker.expirations = tracker.metrics.Counter("tracker_expirations_total", "Number of miners expired without heartbeats.")
+	tracker.metrics.GaugeFunc("tracker_active_miners", "Number of currently registered miners.", func() float64 {
+		tracker.lock.Lock()
+		defer tracker.lock.Unlock()
+		return float64(len(tracker.miners))
+	})
 
 	// register APIs
-	tracker.router.POST("/register", func(ctx *gin.Context) {
+	tracker.router.POST("/register", transport.LimitBody(MaxRegisterRequestSize), func(ctx *gin.Context) {
+		tracker.registerCount.Add(1)
 		var request PortJson
 		if err := ctx.BindJSON(&request); err != nil {
 			ctx.JSON(http.StatusBadRequest, nil)
@@ -48,23 +120,32 @@ func NewTracker(port int) *Tracker {
 		ctx.JSON(statusCode, response)
 	})
 	tracker.router.GET("/get_miners", func(ctx *gin.Context) {
+		tracker.getMinersCount.Add(1)
 		statusCode, response := tracker.getMinersHandler()
 		ctx.JSON(statusCode, response)
 	})
+	tracker.router.GET("/metrics", func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+		ctx.Header("Content-Type", metrics.ContentType)
+		_, _ = tracker.metrics.WriteTo(ctx.Writer)
+	})
+	tracker.router.GET("/status", func(ctx *gin.Context) {
+		tracker.statusCount.Add(1)
+		statusCode, response := tracker.statusHandler()
+		ctx.JSON(statusCode, response)
+	})
 
-	tracker.server = &http.Server{
-		Addr:    fmt.Sprintf("localhost:%d", port),
-		Handler: tracker.router,
-	}
+	tracker.server = transport.NewServer(port, tracker.router)
 
 	return tracker
 }
 
 // Start - starts the Tracker's http server.
 func (t *Tracker) Start() {
+	t.started = time.Now()
 	go func() {
-		if err := t.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("listen: %s\n", err)
+		if err := t.tls.ListenAndServe(t.server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.logger.Error("failed to listen", "error", err)
 		}
 	}()
 }
@@ -74,11 +155,11 @@ func (t *Tracker) Shutdown() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := t.server.Shutdown(ctx); err != nil {
-		log.Println("error when shutting down server: ", err)
+		t.logger.Error("error when shutting down server", "error", err)
 	}
 	select {
 	case <-ctx.Done():
-		log.Println("shutting down server timeout")
+		t.logger.Error("shutting down server timeout")
 	default:
 		break
 	}
@@ -87,19 +168,34 @@ func (t *Tracker) Shutdown() {
 // registerHandler - handles request to /register API.
 func (t *Tracker) registerHandler(request PortJson) (int, any) {
 	port := request.Port
+	if request.Network != t.network {
+		t.logger.Warn("refused a miner of another network", "miner", port, "network", request.Network)
+		return http.StatusForbidden, map[string]string{"error": "miner is on another network"}
+	}
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	timer, ok := t.miners[port]
 	if ok {
 		// stop timer
 		timer.Stop()
+	} else {
+		t.registrations.Inc()
+		t.logger.Info("registered a new miner", "miner", port)
 	}
 	// register a new timer
-	t.miners[port] = time.AfterFunc(EntryTimeout, func() {
+	var expiry *time.Timer
+	expiry = time.AfterFunc(EntryTimeout, func() {
 		t.lock.Lock()
 		defer t.lock.Unlock()
+		if t.miners[port] != expiry {
+			// the timer fired just before a heartbeat stopped it, and the heartbeat registered a new one
+			return
+		}
 		delete(t.miners, port)
+		t.expirations.Inc()
+		t.logger.Info("miner expired without heartbeats", "miner", port)
 	})
+	t.miners[port] = expiry
 	var response PortsJson
 	for port := range t.miners {
 		response.Ports = append(response.Ports, port)
@@ -122,3 +218,23 @@ func (t *Tracker) getMinersHandler() (int, any) {
 	response := PortsJson{Ports: ports}
 	return http.StatusOK, response
 }
+
+// statusHandler - handles request to /status API.
+func (t *Tracker) statusHandler() (int, any) {
+	t.lock.Lock()
+	miners := len(t.miners)
+	t.lock.Unlock()
+	response := StatusJson{
+		Port:    t.port,
+		Network: t.network,
+		Version: blockchain.Version,
+		Uptime:  time.Since(t.started).Milliseconds(),
+		Miners:  miners,
+		Requests: map[string]uint64{
+			"register":   t.registerCount.Load(),
+			"get_miners": t.getMinersCount.Load(),
+			"status":     t.statusCount.Load(),
+		},
+	}
+	return http.StatusOK, response
+}
@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CALifetime - Validity of a throwaway CA and of the certificates it issues.
+const CALifetime = 24 * time.Hour
+
+// CA - A throwaway certificate authority for local networks and tests. Its key only lives in memory.
+type CA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pool        *x509.CertPool // contains only certificate
+}
+
+// NewCA - creates a throwaway CA with a fresh ECDSA P-256 key.
+func NewCA() (*CA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: "blockchain throwaway CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(CALifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(certificate)
+	return &CA{certificate: certificate, key: key, pool: pool}, nil
+}
+
+// randomSerial - a random 128-bit certificate serial number.
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// Pool - a pool that trusts only this CA.
+func (ca *CA) Pool() *x509.CertPool {
+	return ca.pool
+}
+
+// Issue - issues a certificate for localhost and 127.0.0.1, usable both by servers and by clients.
+func (ca *CA) Issue() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(CALifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// Config - issues a certificate and returns a Config that trusts only this CA.
+// Parameters:
+//
+//	mutual (bool): Whether clients must present a certificate issued by this CA.
+func (ca *CA) Config(mutual bool) (*Config, error) {
+	certificate, err := ca.Issue()
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{Certificate: certificate, RootCAs: ca.pool}
+	if mutual {
+		config.ClientCAs = ca.pool
+	}
+	return config, nil
+}
+
+// WriteFiles - issues a certificate and writes it with its key and the CA certificate as PEM files in dir, in the
+// form expected by LoadConfig.
+// Returns:
+//
+//	(string, string, string, error): Paths of the certificate, the key and the CA certificate, and an error if any.
+func (ca *CA) WriteFiles(dir string) (string, string, string, error) {
+	certificate, err := ca.Issue()
+	if err != nil {
+		return "", "", "", err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		return "", "", "", err
+	}
+	certFile := filepath.Join(dir, "node.crt")
+	keyFile := filepath.Join(dir, "node.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	files := map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: certificate.Certificate[0]},
+		keyFile:  {Type: "PRIVATE KEY", Bytes: key},
+		caFile:   {Type: "CERTIFICATE", Bytes: ca.certificate.Raw},
+	}
+	for file, block := range files {
+		if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+			return "", "", "", err
+		}
+	}
+	return certFile, keyFile, caFile, nil
+}
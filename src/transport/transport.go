@@ -0,0 +1,169 @@
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ReadHeaderTimeout - A server waits at most ReadHeaderTimeout for the headers of a request.
+const ReadHeaderTimeout = 5 * time.Second
+
+// ReadTimeout - A server waits at most ReadTimeout for a whole request, including its body.
+const ReadTimeout = 30 * time.Second
+
+// WriteTimeout - A server spends at most WriteTimeout on writing a response, unless the handler clears the deadline.
+const WriteTimeout = 30 * time.Second
+
+// IdleTimeout - A server closes keep-alive connections that have been idle for IdleTimeout.
+const IdleTimeout = 2 * time.Minute
+
+// Config - TLS settings of a node, used both to serve its http endpoints and to send requests to other nodes.
+// A nil *Config means plain HTTP, so that nodes without TLS need no special handling.
+type Config struct {
+	Certificate *tls.Certificate // certificate presented to clients, and to servers that require client certificates
+	RootCAs     *x509.CertPool   // CAs trusted when connecting to other nodes, nil means the system pool
+	ClientCAs   *x509.CertPool   // if not nil, clients must present a certificate signed by one of these CAs
+}
+
+// LoadConfig - loads a Config from PEM files.
+// Parameters:
+//
+//	certFile, keyFile (string): The node's certificate chain and private key. Both may be empty for a client that
+//	does not serve and is not asked for a certificate.
+//	caFile (string): CA certificates trusted when connecting to other nodes. Empty means the system pool.
+//	clientCAFile (string): If not empty, clients must present a certificate signed by one of these CAs.
+//
+// Returns:
+//
+//	(*Config, error): The loaded Config, and an error if any file cannot be read or parsed.
+func LoadConfig(certFile string, keyFile string, caFile string, clientCAFile string) (*Config, error) {
+	config := &Config{}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificate = &certificate
+	}
+	var err error
+	if caFile != "" {
+		if config.RootCAs, err = loadPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	if clientCAFile != "" {
+		if config.ClientCAs, err = loadPool(clientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// loadPool - reads a pool of CA certificates from a PEM file.
+func loadPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// Scheme - "https" if TLS is configured, "http" otherwise.
+func (c *Config) Scheme() string {
+	if c == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// URL - the URL of path on the local node listening on port.
+func (c *Config) URL(port int, path string) string {
+	return fmt.Sprintf("%s://localhost:%d%s", c.Scheme(), port, path)
+}
+
+// Server - the TLS configuration of an http server, nil for plain HTTP.
+func (c *Config) Server() (*tls.Config, error) {
+	if c == nil {
+		return nil, nil
+	}
+	if c.Certificate == nil {
+		return nil, errors.New("TLS is configured without a certificate to serve")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{*c.Certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.ClientCAs != nil {
+		config.ClientCAs = c.ClientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Client - an http client that connects to other nodes, presenting the certificate if there is one. Nodes create it
+// once and reuse it, so that connections are kept alive.
+func (c *Config) Client() *http.Client {
+	if c == nil {
+		return http.DefaultClient
+	}
+	config := &tls.Config{RootCAs: c.RootCAs, MinVersion: tls.VersionTLS12}
+	if c.Certificate != nil {
+		config.Certificates = []tls.Certificate{*c.Certificate}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+// ListenAndServe - serves server with TLS if it is configured, or plain HTTP otherwise.
+func (c *Config) ListenAndServe(server *http.Server) error {
+	config, err := c.Server()
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = config
+	return server.ListenAndServeTLS("", "")
+}
+
+// NewServer - creates an http server for a node listening on localhost:port, with timeouts that keep slow or idle
+// clients from holding connections forever. Handlers that stream responses must clear their write deadline.
+func NewServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf("localhost:%d", port),
+		Handler:           handler,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+	}
+}
+
+// LimitBody - gin middleware that refuses request bodies larger than limit bytes with 413 Request Entity Too Large.
+// Bodies without a declared length are cut at limit, and binding them fails with an error for which TooLarge is true.
+func LimitBody(limit int64) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.Request.ContentLength > limit {
+			ctx.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, map[string]string{"error": "request is too large"})
+			return
+		}
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limit)
+		ctx.Next()
+	}
+}
+
+// TooLarge - checks whether reading a request body failed because it is larger than its limit.
+func TooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
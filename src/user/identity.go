@@ -0,0 +1,148 @@
+package user
+
+import (
+	"blockchain/blockchain"
+	"bytes"
+	"time"
+)
+
+// Post is a post read from the blockchain, with the identity that its user's key resolves to.
+type Post struct {
+	blockchain.Post
+	Height   int                   // height of the block that holds the post
+	Identity *blockchain.PublicKey // the first key of the post's identity, which the post's key was rotated from
+	Revoked  bool                  // whether the post was written with its key after the key was revoked
+}
+
+// identities resolves keys to identities by following the rotations and revocations on a blockchain.
+type identities struct {
+	links     map[string]*blockchain.PublicKey // the key that each key was rotated from
+	rotated   map[string]bool                  // keys that were rotated to another key
+	revokedAt map[string]int                   // height of the block that revoked each revoked key
+}
+
+// resolveIdentities follows the rotations and revocations in blocks, the first of which is at height start.
+// A key may only be rotated once, to a key that no other key was rotated to, and only before it is revoked. Rotations
+// and revocations that break these rules are ignored. A key is revoked by its first revocation.
+func resolveIdentities(blocks []blockchain.Block, start int) *identities {
+	ids := &identities{
+		links:     make(map[string]*blockchain.PublicKey),
+		rotated:   make(map[string]bool),
+		revokedAt: make(map[string]int),
+	}
+	for i, block := range blocks {
+		height := start + i
+		for _, post := range block.Posts {
+			key := string(blockchain.PublicKeyToBytes(post.User))
+			switch post.Body.Kind {
+			case blockchain.PostRotate:
+				newKey := post.RotatedKey()
+				if newKey == nil || ids.rotated[key] || ids.revoked(key, height) {
+					continue
+				}
+				// the new key must not be rotated to twice, nor be the first key of the identity, which makes a cycle
+				if _, ok := ids.links[string(post.Body.NewKey)]; ok ||
+					bytes.Equal(blockchain.PublicKeyToBytes(ids.root(post.User)), post.Body.NewKey) {
+					continue
+				}
+				ids.links[string(post.Body.NewKey)] = post.User
+				ids.rotated[key] = true
+			case blockchain.PostRevoke:
+				if _, ok := ids.revokedAt[key]; !ok {
+					ids.revokedAt[key] = height
+				}
+			}
+		}
+	}
+	return ids
+}
+
+// keyPosts returns the posts that rotate or revoke keys, which are the only ones that identities are resolved from.
+func keyPosts(posts []blockchain.Post) []blockchain.Post {
+	var keys []blockchain.Post
+	for _, post := range posts {
+		if post.Body.Kind == blockchain.PostRotate || post.Body.Kind == blockchain.PostRevoke {
+			keys = append(keys, post)
+		}
+	}
+	return keys
+}
+
+// root returns the first key of the identity of key, which is key itself unless it was rotated to.
+func (ids *identities) root(key *blockchain.PublicKey) *blockchain.PublicKey {
+	for {
+		previous, ok := ids.links[string(blockchain.PublicKeyToBytes(key))]
+		if !ok {
+			return key
+		}
+		key = previous
+	}
+}
+
+// revoked tells whether key, encoded by blockchain.PublicKeyToBytes, was revoked below height.
+func (ids *identities) revoked(key string, height int) bool {
+	revokedAt, ok := ids.revokedAt[key]
+	return ok && height > revokedAt
+}
+
+// resolve attributes post, which is in the block at height, to its identity.
+func (ids *identities) resolve(post blockchain.Post, height int) Post {
+	return Post{
+		Post:     post,
+		Height:   height,
+		Identity: ids.root(post.User),
+		Revoked:  ids.revoked(string(blockchain.PublicKeyToBytes(post.User)), height),
+	}
+}
+
+// RotateKey links the user's key to newKey with a post signed by both keys, then signs the user's later posts with
+// newKey. Readers attribute the posts of both keys to the same identity.
+// Parameters:
+//
+//	newKey (*blockchain.PrivateKey): The key that takes over the user's identity.
+//	reason (string): Why the key is rotated, at most blockchain.MaxContentSize bytes long.
+//
+// Returns:
+//
+//	error: An error if any occurred during the process of writing the post.
+func (u *User) RotateKey(newKey *blockchain.PrivateKey, reason string) error {
+	post := blockchain.Post{
+		User: &u.privateKey.PublicKey,
+		Body: blockchain.PostBody{
+			Content:   reason,
+			Timestamp: time.Now().UnixNano(),
+			Kind:      blockchain.PostRotate,
+			NewKey:    blockchain.PublicKeyToBytes(&newKey.PublicKey),
+		},
+	}
+	post.Signature = blockchain.Sign(u.privateKey, post.Body)
+	post.KeySignature = blockchain.Sign(newKey, post.Body)
+	if err := u.write(post); err != nil {
+		return err
+	}
+	u.privateKey = newKey
+	return nil
+}
+
+// RevokeKey revokes privateKey with a post signed by it, so that readers flag the key's posts in later blocks. To keep
+// an identity whose key has leaked, rotate it to a new key first and then revoke the old key.
+// Parameters:
+//
+//	privateKey (*blockchain.PrivateKey): The key to revoke, which is usually one the user was rotated from.
+//	reason (string): Why the key is revoked, at most blockchain.MaxContentSize bytes long.
+//
+// Returns:
+//
+//	error: An error if any occurred during the process of writing the post.
+func (u *User) RevokeKey(privateKey *blockchain.PrivateKey, reason string) error {
+	post := blockchain.Post{
+		User: &privateKey.PublicKey,
+		Body: blockchain.PostBody{
+			Content:   reason,
+			Timestamp: time.Now().UnixNano(),
+			Kind:      blockchain.PostRevoke,
+		},
+	}
+	post.Signature = blockchain.Sign(privateKey, post.Body)
+	return u.write(post)
+}
@@ -0,0 +1,348 @@
+package user
+
+import (
+	"blockchain/blockchain"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeystoreVersion - Version of the key file format that Keystore writes.
+const KeystoreVersion = 1
+
+// ScryptN - CPU and memory cost of the scrypt key derivation, which makes guessing passphrases expensive.
+const ScryptN = 1 << 15
+
+// ScryptR - Block size of the scrypt key derivation.
+const ScryptR = 8
+
+// ScryptP - Parallelization of the scrypt key derivation.
+const ScryptP = 1
+
+// MaxScryptN, MaxScryptR, MaxScryptP - Load refuses key files whose scrypt parameters exceed these bounds, so that a
+// planted key file cannot make the key derivation take unbounded memory or time.
+const (
+	MaxScryptN = 1 << 20
+	MaxScryptR = 16
+	MaxScryptP = 4
+)
+
+// keyFileSuffix - Suffix of the names of key files in a keystore directory.
+const keyFileSuffix = ".key.json"
+
+// ErrIdentityNotFound is returned when a keystore has no identity of the given name.
+var ErrIdentityNotFound = errors.New("identity not found in keystore")
+
+// ErrIdentityExists is returned when saving an identity under a name that a keystore already holds.
+var ErrIdentityExists = errors.New("identity already exists in keystore")
+
+// ErrWrongPassphrase is returned when an identity cannot be decrypted, because the passphrase is wrong or the key file
+// has been tampered with.
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key file")
+
+// identityName matches the names of identities, which are also the names of their key files.
+var identityName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]{0,63}$`)
+
+// ScryptJson holds the parameters of the scrypt key derivation of a key file.
+type ScryptJson struct {
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt string `json:"salt"`
+}
+
+// KeyFileJson is the content of a key file. The private key, in PKCS #8 form, is encrypted with AES-256-GCM under a
+// key derived from the passphrase with scrypt. The public key is stored in the clear, so that identities can be listed
+// without their passphrases, and is authenticated as the additional data of the encryption.
+type KeyFileJson struct {
+	Version    int        `json:"version"`
+	Scheme     string     `json:"scheme"`
+	PublicKey  string     `json:"public-key"`
+	KDF        string     `json:"kdf"`
+	KDFParams  ScryptJson `json:"kdf-params"`
+	Cipher     string     `json:"cipher"`
+	Nonce      string     `json:"nonce"`
+	Ciphertext string     `json:"ciphertext"`
+}
+
+// Keystore keeps users' private keys in a directory, one passphrase-encrypted key file per named identity, so that
+// a user's identity outlives the process.
+type Keystore struct {
+	dir string
+}
+
+// Identity describes an identity in a keystore without decrypting its private key.
+type Identity struct {
+	Name      string
+	PublicKey *blockchain.PublicKey
+}
+
+// OpenKeystore opens the keystore in the directory dir, creating the directory if it does not exist.
+// Parameters:
+//
+//	dir (string): The directory that holds the key files.
+//
+// Returns:
+//
+//	(*Keystore, error): The keystore, and an error if the directory cannot be created.
+func OpenKeystore(dir string) (*Keystore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Keystore{dir: dir}, nil
+}
+
+// path returns the path of the key file of the identity name.
+func (k *Keystore) path(name string) (string, error) {
+	if !identityName.MatchString(name) {
+		return "", fmt.Errorf("invalid identity name %q", name)
+	}
+	return filepath.Join(k.dir, name+keyFileSuffix), nil
+}
+
+// Save encrypts privateKey with passphrase and stores it as the identity name. It never overwrites an existing
+// identity.
+// Parameters:
+//
+//	name (string): The name of the identity, made of letters, digits, '.', '_' and '-'.
+//	passphrase (string): The passphrase that the private key is encrypted with.
+//	privateKey (*blockchain.PrivateKey): The private key to store.
+//
+// Returns:
+//
+//	error: ErrIdentityExists if the keystore already holds name, or an error if the key file cannot be written.
+func (k *Keystore) Save(name string, passphrase string, privateKey *blockchain.PrivateKey) error {
+	path, err := k.path(name)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	aead, err := newAEAD(passphrase, salt, ScryptN, ScryptR, ScryptP)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	publicKey := blockchain.PublicKeyToBytes(&privateKey.PublicKey)
+	ciphertext := aead.Seal(nil, nonce, blockchain.PrivateKeyToBytes(privateKey), publicKey)
+	file := KeyFileJson{
+		Version:   KeystoreVersion,
+		Scheme:    privateKey.Scheme().String(),
+		PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+		KDF:       "scrypt",
+		KDFParams: ScryptJson{
+			N:    ScryptN,
+			R:    ScryptR,
+			P:    ScryptP,
+			Salt: base64.StdEncoding.EncodeToString(salt),
+		},
+		Cipher:     "aes-256-gcm",
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// O_EXCL refuses to replace an identity, even one saved concurrently
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, fs.ErrExist) {
+		return ErrIdentityExists
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(data); err != nil {
+		out.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return nil
+}
+
+// Load decrypts the private key of the identity name with passphrase.
+// Parameters:
+//
+//	name (string): The name of the identity.
+//	passphrase (string): The passphrase that the private key was saved with.
+//
+// Returns:
+//
+//	(*blockchain.PrivateKey, error): The private key, and ErrIdentityNotFound, ErrWrongPassphrase or another error if
+//	it cannot be loaded.
+func (k *Keystore) Load(name string, passphrase string) (*blockchain.PrivateKey, error) {
+	file, err := k.read(name)
+	if err != nil {
+		return nil, err
+	}
+	if file.KDF != "scrypt" || file.Cipher != "aes-256-gcm" {
+		return nil, fmt.Errorf("key file of %q uses unsupported kdf %q or cipher %q", name, file.KDF, file.Cipher)
+	}
+	params := file.KDFParams
+	if params.N < 2 || params.N > MaxScryptN || params.R < 1 || params.R > MaxScryptR || params.P < 1 || params.P > MaxScryptP {
+		return nil, fmt.Errorf("key file of %q has scrypt parameters out of range: n=%d r=%d p=%d", name, params.N, params.R, params.P)
+	}
+	salt, err := base64.StdEncoding.DecodeString(params.Salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(file.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(file.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(file.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(passphrase, salt, params.N, params.R, params.P)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, publicKey)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return blockchain.PrivateKeyFromBytes(plaintext)
+}
+
+// List returns the identities in the keystore, sorted by name, without decrypting their private keys.
+// Key files that cannot be read are skipped.
+// Returns:
+//
+//	([]Identity, error): The identities, and an error if the directory cannot be read.
+func (k *Keystore) List() ([]Identity, error) {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return nil, err
+	}
+	identities := make([]Identity, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), keyFileSuffix)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		file, err := k.read(name)
+		if err != nil {
+			continue
+		}
+		buffer, err := base64.StdEncoding.DecodeString(file.PublicKey)
+		if err != nil {
+			continue
+		}
+		publicKey, err := blockchain.PublicKeyFromBytes(buffer)
+		if err != nil {
+			continue
+		}
+		identities = append(identities, Identity{Name: name, PublicKey: publicKey})
+	}
+	sort.Slice(identities, func(i, j int) bool {
+		return identities[i].Name < identities[j].Name
+	})
+	return identities, nil
+}
+
+// Delete removes the identity name from the keystore. Its private key is lost unless it is saved elsewhere.
+// Parameters:
+//
+//	name (string): The name of the identity.
+//
+// Returns:
+//
+//	error: ErrIdentityNotFound if the keystore has no identity name, or an error if it cannot be removed.
+func (k *Keystore) Delete(name string) error {
+	path, err := k.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrIdentityNotFound
+	}
+	return err
+}
+
+// read reads and decodes the key file of the identity name.
+func (k *Keystore) read(name string) (*KeyFileJson, error) {
+	path, err := k.path(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrIdentityNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file KeyFileJson
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Version != KeystoreVersion {
+		return nil, fmt.Errorf("key file of %q has unsupported version %d", name, file.Version)
+	}
+	return &file, nil
+}
+
+// newAEAD derives a 256-bit key from passphrase with scrypt, and returns AES-256-GCM under that key.
+func newAEAD(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewUserFromKeystore initializes a User whose posts are signed with the identity name of keystore, so that the user
+// keeps its identity across processes.
+// Parameters:
+//
+//	trackerPort (int): The port number on which the tracker service is running.
+//	keystore (*Keystore): The keystore that holds the identity.
+//	name (string): The name of the identity.
+//	passphrase (string): The passphrase that the identity was saved with.
+//	options (...Option): Optional settings, such as WithTLS or WithNetwork.
+//
+// Returns:
+//
+//	(*User, error): Pointer to the newly created User struct, and an error if the identity cannot be loaded.
+func NewUserFromKeystore(trackerPort int, keystore *Keystore, name string, passphrase string, options ...Option) (*User, error) {
+	privateKey, err := keystore.Load(name, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return NewUser(trackerPort, append(options, WithKey(privateKey))...), nil
+}
@@ -0,0 +1,143 @@
+package user
+
+import (
+	"blockchain/blockchain"
+	"blockchain/miner"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// SyncHeaders brings the user's header chain up to date in light-client mode, which downloads and verifies only block
+// headers. The chain is kept between calls, so only the headers of new blocks are read, from a random subset of
+// miners. They are checked against the mining target and the timestamp rules, which the verified headers below them
+// take part in, and must extend the verified chain; if no miner returns headers that do, the blockchain may have been
+// reorganised, and the header chain is read again from the genesis block.
+// A shorter chain than the verified one is never adopted.
+// Returns:
+//
+//	(int, error): The height of the verified header chain, and an error if it could not be brought up to date.
+func (u *User) SyncHeaders() (int, error) {
+	u.lightLock.Lock()
+	defer u.lightLock.Unlock()
+	if err := u.extendHeaders(len(u.headers)); err != nil {
+		if err := u.extendHeaders(0); err != nil {
+			return len(u.headers), err
+		}
+	}
+	return len(u.headers), nil
+}
+
+// extendHeaders replaces the verified headers from height from on with those of the longest valid chain that links to
+// the verified headers below from. The caller must hold lightLock.
+func (u *User) extendHeaders(from int) error {
+	segments, err := u.readSegments(ReadOptions{From: from}, true)
+	if err != nil {
+		return err
+	}
+	for _, chain := range segments {
+		// the claimed height is not verified, only the headers returned are
+		if from+len(chain.blocks) < len(u.headers) || chain.start != from {
+			continue
+		}
+		// the verified headers below from complete the median time past of the first blocks
+		err := blockchain.ValidateChain(chain.blocks, blockchain.ValidateOptions{
+			Network: &u.network,
+			Start:   from,
+			Prev:    u.headers[max(from-blockchain.MedianTimeSpan, 0):from],
+			Now:     time.Now(),
+			Partial: true,
+		})
+		if err != nil {
+			continue
+		}
+		if from > 0 && len(chain.blocks) > 0 && !bytes.Equal(chain.blocks[0].Header.PrevHash, u.headers[from-1].Hash()) {
+			continue
+		}
+		u.headers = append(u.headers[:from:from], chain.blocks...)
+		return nil
+	}
+	return errors.New("failed to receive a valid blockchain")
+}
+
+// ReadPost reads a single post in light-client mode, without downloading any block body. It brings the header chain
+// up to date with SyncHeaders, and then asks miners one at a time for the post of author at timestamp, along with the
+// Merkle proof that the summary of its block covers it. The first post whose proof matches the verified header of its
+// block, and whose signature and timestamp are valid, is returned.
+// Identities cannot be resolved without every post of the blockchain, so the Identity of the returned post is its own
+// key and it is never flagged as revoked.
+// Parameters:
+//
+//	author (*blockchain.PublicKey): The key that the post was written with.
+//	timestamp (int64): The timestamp of the post, which no other post of author shares.
+//
+// Returns:
+//
+//	(Post, error): The verified post with the height of its block, and an error if no miner proves it to be on the blockchain.
+func (u *User) ReadPost(author *blockchain.PublicKey, timestamp int64) (Post, error) {
+	if _, err := u.SyncHeaders(); err != nil {
+		return Post{}, err
+	}
+	miners, err := u.GetRandomMiners()
+	if err != nil {
+		return Post{}, err
+	}
+	query := url.Values{}
+	query.Set("user", base64.StdEncoding.EncodeToString(blockchain.PublicKeyToBytes(author)))
+	query.Set("timestamp", strconv.FormatInt(timestamp, 10))
+	for _, port := range miners {
+		post, err := u.readProof(port, query)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(blockchain.PublicKeyToBytes(post.User), blockchain.PublicKeyToBytes(author)) ||
+			post.Body.Timestamp != timestamp {
+			continue
+		}
+		return post, nil
+	}
+	return Post{}, errors.New("no miner proves the post to be on the blockchain")
+}
+
+// readProof asks a single miner for the post selected by query, and verifies it against the header chain.
+func (u *User) readProof(port int, query url.Values) (Post, error) {
+	resp, err := u.client.Get(u.tls.URL(port, "/proof?"+query.Encode()))
+	if err != nil {
+		return Post{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Post{}, errors.New("miner does not prove the post")
+	}
+	var respJson miner.ProofJson
+	if err := json.NewDecoder(resp.Body).Decode(&respJson); err != nil {
+		return Post{}, err
+	}
+	post, err := respJson.Post.DecodeBase64()
+	if err != nil {
+		return Post{}, err
+	}
+	proof, err := respJson.Proof.DecodeBase64()
+	if err != nil {
+		return Post{}, err
+	}
+
+	u.lightLock.Lock()
+	defer u.lightLock.Unlock()
+	if respJson.Height < 0 || respJson.Height >= len(u.headers) {
+		return Post{}, errors.New("post is in a block beyond the header chain")
+	}
+	header := &u.headers[respJson.Height].Header
+	if !proof.Verify(&post, header.Summary) {
+		return Post{}, errors.New("proof does not match the block header")
+	}
+	if post.User.Validate() != nil || !post.Verify() || !post.VerifyTime(header.Timestamp) {
+		return Post{}, errors.New("post is invalid")
+	}
+	return Post{Post: post, Height: respJson.Height, Identity: post.User}, nil
+}
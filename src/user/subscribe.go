@@ -0,0 +1,225 @@
+package user
+
+import (
+	"blockchain/blockchain"
+	"blockchain/miner"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReconnectDelay - Subscribe waits for ReconnectDelay before connecting to another miner after a stream ends.
+const ReconnectDelay = 500 * time.Millisecond
+
+// errResync - the stream is inconsistent with the blocks seen so far, and must be restarted from an earlier height.
+var errResync = errors.New("stream is inconsistent with the blocks seen so far")
+
+// subscription keeps the state of Subscribe across reconnections.
+type subscription struct {
+	user    *User              // the subscriber, whose client connects to miners
+	filter  ReadOptions        // filters of the posts to yield
+	headers []blockchain.Block // verified blocks with only their key posts, indexed by height, linked to the genesis block
+	ids     *identities        // identities resolved from the key posts of headers, nil until they are needed again
+	seen    map[string]int     // heights of the blocks of yielded posts, by post ID, down to the finality depth
+	out     chan Post
+}
+
+// Subscribe follows the blockchain through a miner's /events stream and yields verified posts in blockchain order.
+// Blocks are replayed from filter.From, and the stream continues with new blocks as they are mined. Each block must be
+// valid, be dated after the blocks below it and not in the future, and extend the previously verified block, otherwise
+// the stream is restarted. When filter.From is above 0, the header chain up to it is first verified from the genesis
+// block with SyncHeaders, so that the first blocks streamed are checked against verified parents. When a stream ends,
+// Subscribe reconnects to a random miner and replays from the last verified height. A post is yielded at most once,
+// even if it moves to another block after a reorg that miners accept, which is no deeper than their finality depth, as
+// WithFinalityDepth tells it; posts of discarded blocks cannot be taken back. Posts of blocks that the miner has pruned
+// are not yielded. Each post is attributed to an identity, and flagged if its key was revoked, as ReadPosts does, by
+// following the key rotations and revocations of the blocks below it and its own. When filter.From is above 0, those
+// below filter.From are only followed if filter.Identities is set, from a read of the complete blocks below it, and
+// Subscribe fails if no miner returns them for the verified headers. Rotations and revocations in blocks that the miner
+// has pruned are not seen either.
+// Parameters:
+//
+//	ctx (context.Context): Cancelling ctx ends the subscription and closes the returned channel.
+//	filter (ReadOptions): From selects the first height, Author, Since and Until filter the yielded posts, and
+//	Identities resolves identities from the blocks below From.
+//
+// Returns:
+//
+//	(<-chan Post, error): A channel of verified posts, and an error if no miner can be found at all, or the headers
+//	below filter.From, or the blocks asked for by filter.Identities, cannot be verified.
+func (u *User) Subscribe(ctx context.Context, filter ReadOptions) (<-chan Post, error) {
+	if _, err := u.GetRandomMiners(); err != nil {
+		return nil, err
+	}
+	headers := make([]blockchain.Block, 0)
+	if filter.From > 0 {
+		if _, err := u.SyncHeaders(); err != nil {
+			return nil, err
+		}
+		u.lightLock.Lock()
+		headers = append(headers, u.headers[:min(filter.From, len(u.headers))]...)
+		u.lightLock.Unlock()
+		if filter.Identities {
+			complete, err := u.readCompleteBlocks(headers, 0, filter.PageSize)
+			if err != nil {
+				return nil, err
+			}
+			for i := range headers {
+				headers[i].Posts = keyPosts(complete[i].Posts)
+			}
+		}
+	}
+	s := &subscription{
+		user:    u,
+		filter:  filter,
+		headers: headers,
+		seen:    make(map[string]int),
+		out:     make(chan Post),
+	}
+	go func() {
+		defer close(s.out)
+		for ctx.Err() == nil {
+			// errors only mean that the stream has ended, and another miner should be tried
+			if miners, err := u.GetRandomMiners(); err == nil && len(miners) > 0 {
+				_ = s.follow(ctx, miners[rand.Intn(len(miners))])
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(ReconnectDelay):
+			}
+		}
+	}()
+	return s.out, nil
+}
+
+// follow reads one /events stream until it ends. The stream starts one block before the next height, so that the
+// first block received can be checked against the last verified block.
+func (s *subscription) follow(ctx context.Context, port int) error {
+	from := max(len(s.headers)-1, 0)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.user.tls.URL(port, fmt.Sprintf("/events?from=%d", from)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.user.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("miner rejected subscription: status code %d", resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			// event names are repeated in the data, and blank lines only separate events
+			continue
+		}
+		var event miner.EventJson
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			return err
+		}
+		if err := s.handle(ctx, event); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// forget drops the yielded posts of blocks below height. Miners refuse reorgs deeper than their finality depth, so
+// those posts cannot move to a new block and be yielded again.
+func (s *subscription) forget(height int) {
+	for key, seen := range s.seen {
+		if seen < height {
+			delete(s.seen, key)
+		}
+	}
+}
+
+// handle applies one event to the subscription, yielding the posts of new blocks.
+func (s *subscription) handle(ctx context.Context, event miner.EventJson) error {
+	switch event.Type {
+	case miner.EventReorg:
+		if event.Height < len(s.headers) {
+			s.headers = s.headers[:event.Height]
+			s.ids = nil
+		}
+		return nil
+	case miner.EventBlock:
+		if event.Block == nil {
+			return errResync
+		}
+	default:
+		// pool admissions are not on the blockchain yet
+		return nil
+	}
+	block, err := event.Block.DecodeBase64()
+	if err != nil {
+		return err
+	}
+	hash := block.Hash()
+	height := event.Height
+	if height > len(s.headers) {
+		return errResync
+	}
+	if height < len(s.headers) {
+		if bytes.Equal(s.headers[height].Hash(), hash) {
+			// a replayed block
+			return nil
+		}
+		// the miner is on another branch from this height
+		s.headers = s.headers[:height]
+		s.ids = nil
+	}
+	// the block must follow every consensus rule, with the verified blocks below it completing its median time past;
+	// blocks that the miner has pruned are only checked by their headers, and have no posts to yield
+	options := blockchain.ValidateOptions{
+		Network: &s.user.network,
+		Start:   height,
+		Prev:    s.headers[max(height-blockchain.MedianTimeSpan, 0):height],
+		Now:     time.Now(),
+	}
+	if block.IsPruned() {
+		options.Pruned = height + 1
+	}
+	if blockchain.ValidateChain([]blockchain.Block{block}, options) != nil {
+		return errResync
+	}
+	if height > 0 && !bytes.Equal(block.Header.PrevHash, s.headers[height-1].Hash()) {
+		return errResync
+	}
+	keys := keyPosts(block.Posts)
+	s.headers = append(s.headers, blockchain.Block{Header: block.Header, Posts: keys})
+	if len(keys) > 0 {
+		s.ids = nil
+	}
+	s.forget(height - s.user.finality)
+	if height < s.filter.From {
+		return nil
+	}
+	for _, post := range block.Posts {
+		key := string(post.ID())
+		if _, ok := s.seen[key]; ok || !s.filter.matches(post) {
+			continue
+		}
+		s.seen[key] = height
+		if s.ids == nil {
+			s.ids = resolveIdentities(s.headers, 0)
+		}
+		select {
+		case s.out <- s.ids.resolve(post, height):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -4,15 +4,18 @@ import (
 	"blockchain/blockchain"
 	"blockchain/miner"
 	"blockchain/tracker"
+	"blockchain/transport"
 	"bytes"
-	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/emirpasic/gods/sets/treeset"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -20,27 +23,85 @@ import (
 // RWCount - Number of miners to select for writing posts
 const RWCount = 3
 
+// ErrIncompleteRead is returned by ReadPosts when only miners that have pruned the posts of blocks in the range return
+// a blockchain, so that the posts of those blocks can neither be read nor checked against their summaries.
+var ErrIncompleteRead = errors.New("miners have pruned the posts of blocks in the range")
+
 // User represents a user in the blockchain system
 type User struct {
-	privateKey  *rsa.PrivateKey
+	privateKey  *blockchain.PrivateKey
 	trackerPort int
+	network     blockchain.Network // network whose consensus rules the blockchain must follow
+	tls         *transport.Config  // TLS settings, nil for plain HTTP
+	client      *http.Client       // sends requests to the tracker and miners
+	finality    int                // maximum number of blocks that the miners' reorgs may discard
+
+	lightLock sync.Mutex         // guards headers
+	headers   []blockchain.Block // header chain verified by SyncHeaders, from height 0 and without posts
+}
+
+// Option is an optional setting of NewUser.
+type Option func(u *User)
+
+// WithTLS connects to the tracker and miners over TLS, presenting config's certificate if they require one.
+func WithTLS(config *transport.Config) Option {
+	return func(u *User) {
+		u.tls = config
+	}
+}
+
+// WithNetwork reads and verifies the chain of network instead of blockchain.MainNetwork.
+func WithNetwork(network blockchain.Network) Option {
+	return func(u *User) {
+		u.network = network
+	}
+}
+
+// WithFinalityDepth follows miners that refuse reorgs deeper than depth blocks, as miner.WithFinalityDepth configures
+// them, instead of miner.FinalityDepth.
+func WithFinalityDepth(depth int) Option {
+	return func(u *User) {
+		u.finality = depth
+	}
+}
+
+// WithKey signs the user's posts with privateKey, which may be of any signature scheme, instead of a new Ed25519 key.
+func WithKey(privateKey *blockchain.PrivateKey) Option {
+	return func(u *User) {
+		u.privateKey = privateKey
+	}
 }
 
 // NewUser initializes a new instance of a User with a specific tracker port.
-// The function generates a new RSA private key for the user and returns a User struct with the initialized values.
+// Unless WithKey is given, the function generates a new Ed25519 private key for the user. It returns a User struct
+// with the initialized values.
 // Parameters:
 //
 //	trackerPort (int): The port number on which the tracker service is running.
+//	options (...Option): Optional settings, such as WithTLS, WithNetwork or WithKey.
 //
 // Returns:
 //
 //	*User: Pointer to the newly created User struct.
-func NewUser(trackerPort int) *User {
-	privateKey := blockchain.GenerateKey()
-	return &User{
-		privateKey:  privateKey,
+func NewUser(trackerPort int, options ...Option) *User {
+	user := &User{
 		trackerPort: trackerPort,
+		network:     blockchain.MainNetwork,
+		finality:    miner.FinalityDepth,
+	}
+	for _, option := range options {
+		option(user)
 	}
+	if user.privateKey == nil {
+		user.privateKey = blockchain.GenerateKey()
+	}
+	user.client = user.tls.Client()
+	return user
+}
+
+// PublicKey returns the public key that identifies the user's posts.
+func (u *User) PublicKey() *blockchain.PublicKey {
+	return &u.privateKey.PublicKey
 }
 
 // GetRandomMiners retrieves a random subset of miners from the tracker service.
@@ -52,7 +113,7 @@ func NewUser(trackerPort int) *User {
 //	([]int, error): A slice of selected miner ports and an error, if any occurred during the process.
 func (u *User) GetRandomMiners() ([]int, error) {
 	// Send a GET request to the tracker's "/get_miners" endpoint
-	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/get_miners", u.trackerPort))
+	resp, err := u.client.Get(u.tls.URL(u.trackerPort, "/get_miners"))
 	if err != nil {
 		return nil, err
 	}
@@ -86,58 +147,187 @@ func (u *User) GetRandomMiners() ([]int, error) {
 	return ports[:RWCount], nil
 }
 
-// ReadPosts retrieves posts from a random subset of miners and consolidates them into a single, validated list.
-// The function first retrieves a list of active miners and then concurrently fetches and decodes their stored blockchains.
-// It verifies each blockchain's integrity and consistency, ensuring each block is valid and properly linked.
-// Finally, it extracts and returns a de-duplicated list of posts sorted by their timestamp and user public key.
-// Returns:
-//
-//	([]blockchain.Post, error): A slice of blockchain posts that have been validated and sorted, and an error, if any occurred.
-func (u *User) ReadPosts() ([]blockchain.Post, error) {
+// ReadOptions narrows down the blocks and posts fetched by ReadPosts and ReadHeaders.
+// The zero value reads the complete blockchain in a single request per miner.
+type ReadOptions struct {
+	From     int                   // height of the first block to read
+	To       int                   // only read blocks below this height, 0 means up to the tip
+	PageSize int                   // number of blocks fetched per /read request, 0 means the whole range at once
+	Author   *blockchain.PublicKey // only read posts written by Author, nil means all users
+	Since    int64                 // only read posts with Timestamp >= Since, 0 means no lower bound
+	Until    int64                 // only read posts with Timestamp < Until, 0 means no upper bound
+
+	// Identities resolves the identities of the posts of a read that is filtered or starts above the genesis block, or
+	// of a subscription that starts above it, from a separate read of every complete block below its end, or below
+	// From for a subscription, which costs as much as reading the whole blockchain.
+	Identities bool
+}
+
+// filtered reports whether the options filter posts inside blocks, in which case block summaries cannot be verified.
+func (o *ReadOptions) filtered() bool {
+	return o.Author != nil || o.Since != 0 || o.Until != 0
+}
+
+// matches reports whether a post passes the author and timestamp filters of the options.
+func (o *ReadOptions) matches(post blockchain.Post) bool {
+	if o.Author != nil && !bytes.Equal(blockchain.PublicKeyToBytes(o.Author), blockchain.PublicKeyToBytes(post.User)) {
+		return false
+	}
+	return post.Body.Timestamp >= o.Since && (o.Until == 0 || post.Body.Timestamp < o.Until)
+}
+
+// segment is a consecutive range of a miner's blockchain as returned by /read.
+type segment struct {
+	height int                // length of the miner's complete blockchain
+	start  int                // height of the first block in blocks
+	pruned int                // height below which the miner has pruned its blocks, which are read without posts
+	blocks []blockchain.Block // the blocks read from the miner
+}
+
+// readSegment fetches the blocks selected by options from a single miner, following the pagination cursor
+// until the whole range has been read. The miner must return every block of the range up to the height it claims.
+func (u *User) readSegment(port int, options ReadOptions, headers bool) (*segment, error) {
+	query := url.Values{}
+	if options.From > 0 {
+		query.Set("from", strconv.Itoa(options.From))
+	}
+	if options.To > 0 {
+		query.Set("to", strconv.Itoa(options.To))
+	}
+	if options.PageSize > 0 {
+		query.Set("limit", strconv.Itoa(options.PageSize))
+	}
+	if options.Author != nil {
+		query.Set("author", base64.StdEncoding.EncodeToString(blockchain.PublicKeyToBytes(options.Author)))
+	}
+	if options.Since != 0 {
+		query.Set("since", strconv.FormatInt(options.Since, 10))
+	}
+	if options.Until != 0 {
+		query.Set("until", strconv.FormatInt(options.Until, 10))
+	}
+	if headers {
+		query.Set("headers", "true")
+	}
+
+	var result *segment
+	for {
+		resp, err := u.client.Get(u.tls.URL(port, "/read?"+query.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("miner refused to read: status code %d", resp.StatusCode)
+		}
+		var respJson miner.ReadJson
+		err = json.NewDecoder(resp.Body).Decode(&respJson)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			if respJson.Start != options.From {
+				return nil, errors.New("miner returns blocks from another height than asked for")
+			}
+			result = &segment{start: respJson.Start}
+		} else if respJson.Start != result.start+len(result.blocks) {
+			return nil, errors.New("miner returns a page that does not continue the previous one")
+		}
+		// the miner may mine blocks between pages, so its last page is the one it answers for
+		result.height, result.pruned = respJson.Height, respJson.Pruned
+		for _, encoded := range respJson.Blockchain {
+			decoded, err := encoded.DecodeBase64()
+			if err != nil {
+				return nil, err
+			}
+			result.blocks = append(result.blocks, decoded)
+		}
+		if respJson.Next == 0 {
+			break
+		}
+		if len(respJson.Blockchain) == 0 || respJson.Next != respJson.Start+len(respJson.Blockchain) {
+			return nil, errors.New("miner returns a cursor that does not advance")
+		}
+		query.Set("cursor", strconv.Itoa(respJson.Next))
+	}
+	// filters only drop posts, never blocks, so every block of the range must be there
+	end := result.height
+	if options.To > 0 {
+		end = min(end, options.To)
+	}
+	if len(result.blocks) != max(end-result.start, 0) {
+		return nil, errors.New("miner returns fewer or more blocks than its blockchain holds")
+	}
+	return result, nil
+}
+
+// readSegments concurrently reads the same range from a random subset of miners, and returns the segments sorted
+// from the most blocks read to the fewest, and then from the least pruned to the most pruned one. Miners are ranked by
+// the blocks they return rather than by the height they claim. Miners that fail to respond are left out.
+func (u *User) readSegments(options ReadOptions, headers bool) ([]*segment, error) {
 	miners, err := u.GetRandomMiners()
 	if err != nil {
 		return nil, err
 	}
 
-	// send concurrent requests to get each miner's blockchain
-	respChan := make(chan []blockchain.Block)
+	respChan := make(chan *segment)
 	for _, port := range miners {
-		port := port
 		go func(port int) {
-			resp, err := http.Get(fmt.Sprintf("http://localhost:%d/read", port))
-			if err != nil {
-				respChan <- nil
-				return
-			}
-			defer resp.Body.Close()
-
-			var respJson miner.BlockChainJson
-			err = json.NewDecoder(resp.Body).Decode(&respJson)
+			result, err := u.readSegment(port, options, headers)
 			if err != nil {
 				respChan <- nil
 				return
 			}
-			// retrieve blockchain
-			chain := make([]blockchain.Block, 0)
-			for _, encoded := range respJson.Blockchain {
-				decoded, err := encoded.DecodeBase64()
-				if err != nil {
-					respChan <- nil
-					return
-				}
-				chain = append(chain, decoded)
-			}
-			respChan <- chain
+			respChan <- result
 		}(port)
 	}
-	chains := make([][]blockchain.Block, 0)
+	segments := make([]*segment, 0)
 	for i := 0; i < len(miners); i++ {
-		chains = append(chains, <-respChan)
+		if result := <-respChan; result != nil {
+			segments = append(segments, result)
+		}
 	}
-	// sort the chains from longest to shortest
-	sort.Slice(chains, func(i, j int) bool {
-		return len(chains[i]) > len(chains[j])
+	sort.Slice(segments, func(i, j int) bool {
+		end1, end2 := segments[i].start+len(segments[i].blocks), segments[j].start+len(segments[j].blocks)
+		if end1 != end2 {
+			return end1 > end2
+		}
+		return segments[i].pruned < segments[j].pruned
 	})
+	return segments, nil
+}
+
+// ReadPosts retrieves posts from a random subset of miners and consolidates them into a single, validated list.
+// The function first retrieves a list of active miners and then concurrently fetches and decodes their stored blockchains.
+// It verifies each blockchain's integrity and consistency, ensuring each block is valid and properly linked.
+// Finally, it extracts and returns a de-duplicated list of posts sorted by their timestamp and user public key.
+// Each post is attributed to an identity by following the key rotations on the blockchain, and is flagged if its key
+// was revoked in an earlier block.
+// An optional ReadOptions limits the blocks and posts that are fetched. When it filters posts by author or timestamp,
+// block summaries cannot be checked, and only the signatures of the returned posts are verified. Unless every post from
+// the genesis block on is read, identities are only resolved if options.Identities is set, from a separate read of the
+// complete blocks below the last one, whose summaries are checked so that no rotation or revocation is left out, and
+// ReadPosts fails if no miner returns them for the same blockchain. Otherwise, as with ReadPost, the Identity of each
+// post is its own key and no post is flagged as revoked. Miners that prune old blocks return them
+// without posts, which cannot be checked, so their blockchains are skipped; if no other miner returns a valid one,
+// ReadPosts fails with ErrIncompleteRead.
+// Parameters:
+//
+//	options (...ReadOptions): At most one set of options narrowing down the posts to read.
+//
+// Returns:
+//
+//	([]Post, error): A slice of blockchain posts that have been validated, resolved and sorted, and an error, if any occurred.
+func (u *User) ReadPosts(options ...ReadOptions) ([]Post, error) {
+	var opts ReadOptions
+	if len(options) > 0 {
+		opts = options[0]
+	}
+	segments, err := u.readSegments(opts, false)
+	if err != nil {
+		return nil, err
+	}
 
 	// find the first valid chain
 	cmp := func(a, b any) int {
@@ -155,58 +345,161 @@ func (u *User) ReadPosts() ([]blockchain.Post, error) {
 		return bytes.Compare(key1, key2)
 	}
 	var posts *treeset.Set
+	var ids *identities
+	heights := make(map[string]int)
+	incomplete := false
 VerifyChains:
-	for _, chain := range chains {
-		if len(chain) == 0 {
+	for _, chain := range segments {
+		if len(chain.blocks) == 0 && chain.height == 0 {
 			continue VerifyChains
 		}
-		// each block must be valid
-		for _, block := range chain {
-			if !block.Verify() {
-				continue VerifyChains
-			}
+		// blocks without their posts would pass for blocks without posts
+		if chain.pruned > chain.start && len(chain.blocks) > 0 {
+			incomplete = true
+			continue VerifyChains
 		}
-		// their hash value must form a chain
-		if !bytes.Equal(chain[0].Header.PrevHash, make([]byte, 32)) {
+		// the blocks must follow the consensus rules
+		err := blockchain.ValidateChain(chain.blocks, blockchain.ValidateOptions{
+			Network: &u.network,
+			Start:   chain.start,
+			Partial: opts.filtered(),
+		})
+		if err != nil {
 			continue VerifyChains
 		}
-		for i := 1; i < len(chain); i++ {
-			if !bytes.Equal(chain[i].Header.PrevHash, blockchain.Hash(chain[i-1].Header)) {
-				continue VerifyChains
+		// and hold only the posts they were asked for
+		if opts.filtered() {
+			for _, block := range chain.blocks {
+				for _, post := range block.Posts {
+					if !opts.matches(post) {
+						continue VerifyChains
+					}
+				}
 			}
 		}
-		// no duplicated posts
 		posts = treeset.NewWith(cmp)
-		for _, block := range chain {
+		for i, block := range chain.blocks {
 			for _, post := range block.Posts {
-				if posts.Contains(post) {
-					posts = nil
-					continue VerifyChains
-				}
 				posts.Add(post)
+				heights[string(post.ID())] = chain.start + i
+			}
+		}
+		// done; the blocks only show every rotation and revocation if they hold every post from the genesis block on
+		switch {
+		case !opts.filtered() && chain.start == 0:
+			ids = resolveIdentities(chain.blocks, 0)
+		case opts.Identities:
+			ids, err = u.readIdentities(chain, opts.PageSize)
+			if err != nil {
+				return nil, err
 			}
+		default:
+			ids = resolveIdentities(nil, 0)
 		}
-		// done
 		break
 	}
+	if posts == nil && incomplete {
+		return nil, ErrIncompleteRead
+	}
 	if posts == nil {
 		return nil, errors.New("failed to receive a valid blockchain")
 	}
-	postsList := make([]blockchain.Post, 0)
+	postsList := make([]Post, 0)
 	iter := posts.Iterator()
 	for iter.Next() {
-		postsList = append(postsList, iter.Value().(blockchain.Post))
+		post := iter.Value().(blockchain.Post)
+		postsList = append(postsList, ids.resolve(post, heights[string(post.ID())]))
 	}
 	return postsList, nil
 }
 
+// readIdentities resolves identities from the posts that rotate or revoke keys in every block below the end of chain,
+// which chain may lack if it was filtered or does not start from the genesis block.
+func (u *User) readIdentities(chain *segment, pageSize int) (*identities, error) {
+	blocks, err := u.readCompleteBlocks(chain.blocks, chain.start, pageSize)
+	if err != nil {
+		return nil, err
+	}
+	return resolveIdentities(blocks, 0), nil
+}
+
+// readCompleteBlocks reads every block below the end of blocks, the first of which is at height start, in full. The
+// blocks are read from the same blockchain as blocks, and from a miner that has not pruned any of it, so that their
+// summaries prove that no key post was left out.
+func (u *User) readCompleteBlocks(blocks []blockchain.Block, start int, pageSize int) ([]blockchain.Block, error) {
+	end := start + len(blocks)
+	if end == 0 {
+		return nil, nil
+	}
+	segments, err := u.readSegments(ReadOptions{To: end, PageSize: pageSize}, false)
+	if err != nil {
+		return nil, err
+	}
+VerifyKeys:
+	for _, keys := range segments {
+		if len(keys.blocks) != end || keys.pruned > 0 {
+			continue
+		}
+		if err := blockchain.ValidateChain(keys.blocks, blockchain.ValidateOptions{Network: &u.network}); err != nil {
+			continue
+		}
+		for i := start; i < end; i++ {
+			if !bytes.Equal(keys.blocks[i].Hash(), blocks[i-start].Hash()) {
+				continue VerifyKeys
+			}
+		}
+		return keys.blocks, nil
+	}
+	return nil, errors.New("failed to read the key rotations and revocations of the blockchain")
+}
+
+// ReadHeaders retrieves only the block headers of the longest valid blockchain from a random subset of miners.
+// Headers are checked against the mining target and must form a chain, but the posts they summarize are not fetched.
+// Author and timestamp filters in the options are ignored.
+// Parameters:
+//
+//	options (...ReadOptions): At most one set of options selecting the height range and page size.
+//
+// Returns:
+//
+//	([]blockchain.BlockHeader, error): The validated headers starting from options.From, and an error, if any occurred.
+func (u *User) ReadHeaders(options ...ReadOptions) ([]blockchain.BlockHeader, error) {
+	var opts ReadOptions
+	if len(options) > 0 {
+		opts = ReadOptions{From: options[0].From, To: options[0].To, PageSize: options[0].PageSize}
+	}
+	segments, err := u.readSegments(opts, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, chain := range segments {
+		if chain.height == 0 {
+			continue
+		}
+		err := blockchain.ValidateChain(chain.blocks, blockchain.ValidateOptions{
+			Network: &u.network,
+			Start:   chain.start,
+			Partial: true,
+		})
+		if err != nil {
+			continue
+		}
+		headers := make([]blockchain.BlockHeader, 0)
+		for _, block := range chain.blocks {
+			headers = append(headers, block.Header)
+		}
+		return headers, nil
+	}
+	return nil, errors.New("failed to receive a valid blockchain")
+}
+
 // WritePost creates and signs a new post with the user's private key, then concurrently sends it to a subset of miners.
 // It generates a new post using the provided content and current timestamp, signs it, and encodes it in base64 format.
 // The function then retrieves a list of active miners and sends the post to each via a POST request.
 // It waits for all requests to complete and checks for errors, returning the first encountered error.
 // Parameters:
 //
-//	content (string): The content of the post to be created.
+//	content (string): The content of the post to be created, at most blockchain.MaxContentSize bytes long.
 //
 // Returns:
 //
@@ -223,6 +516,14 @@ func (u *User) WritePost(content string) error {
 
 	// Sign the post using the user's private key
 	post.Signature = blockchain.Sign(u.privateKey, post.Body)
+	return u.write(post)
+}
+
+// write sends a signed post to a subset of miners concurrently, returning the first error encountered.
+func (u *User) write(post blockchain.Post) error {
+	if len(post.Body.Content) > blockchain.MaxContentSize {
+		return fmt.Errorf("content is longer than %d bytes", blockchain.MaxContentSize)
+	}
 
 	// Encode the post to base64
 	postBase64 := post.EncodeBase64()
@@ -246,7 +547,7 @@ func (u *User) WritePost(content string) error {
 
 			// Send a POST request to the miner's "/write" endpoint with the post data
 			postJSON, _ := json.Marshal(postBase64)
-			resp, err := http.Post(fmt.Sprintf("http://localhost:%d/write", port), "application/json", bytes.NewReader(postJSON))
+			resp, err := u.client.Post(u.tls.URL(port, "/write"), "application/json", bytes.NewReader(postJSON))
 			if err != nil {
 				errChan <- err
 				return